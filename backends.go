@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// used when OLLAMA_HOSTS isn't set
+const DEFAULT_OLLAMA_HOST = "http://ollama.local:11111"
+
+const HEALTH_CHECK_INTERVAL = 15 * time.Second
+
+const HEALTH_CHECK_TIMEOUT = 5 * time.Second
+
+var errNoBackend = errors.New("no healthy Ollama backend available")
+
+// ollamaBackend is one of the Ollama hosts from OLLAMA_HOSTS, along with what
+// its last health check (a call to /api/ps) found out
+type ollamaBackend struct {
+	Host      string
+	mu        sync.Mutex
+	healthy   bool
+	loaded    map[string]bool
+	active    int
+	lastCheck time.Time
+	lastError string
+}
+
+type BackendStatus struct {
+	Host      string    `json:"host"`
+	Healthy   bool      `json:"healthy"`
+	Loaded    []string  `json:"loaded"`
+	Active    int       `json:"active"`
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+var backends = loadBackends()
+
+// loadBackends reads the comma separated OLLAMA_HOSTS environment variable
+func loadBackends() []*ollamaBackend {
+	var list []*ollamaBackend
+	for _, host := range strings.Split(os.Getenv("OLLAMA_HOSTS"), ",") {
+		host = strings.TrimRight(strings.TrimSpace(host), "/")
+		if host != "" {
+			// considered healthy until the first check says otherwise
+			list = append(list, &ollamaBackend{Host: host, healthy: true, loaded: map[string]bool{}})
+		}
+	}
+	if len(list) == 0 {
+		list = append(list, &ollamaBackend{Host: DEFAULT_OLLAMA_HOST, healthy: true, loaded: map[string]bool{}})
+	}
+	return list
+}
+
+func (b *ollamaBackend) status() BackendStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := BackendStatus{Host: b.Host, Healthy: b.healthy, Loaded: []string{}, Active: b.active, LastCheck: b.lastCheck, LastError: b.lastError}
+	for model := range b.loaded {
+		status.Loaded = append(status.Loaded, model)
+	}
+	return status
+}
+
+func (b *ollamaBackend) isHealthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.healthy
+}
+
+func (b *ollamaBackend) markUnhealthy(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.healthy = false
+	b.lastError = err.Error()
+}
+
+func (b *ollamaBackend) acquire() {
+	b.mu.Lock()
+	b.active++
+	b.mu.Unlock()
+}
+
+func (b *ollamaBackend) release() {
+	b.mu.Lock()
+	b.active--
+	b.mu.Unlock()
+}
+
+// fetchPs asks the backend which models it has loaded
+func (b *ollamaBackend) fetchPs(timeout time.Duration) (PsModelsData, error) {
+	var models PsModelsData
+	client := &http.Client{
+		Timeout: timeout,
+	}
+	resp, err := client.Get(b.Host + "/api/ps")
+	if err != nil {
+		return models, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return models, fmt.Errorf("%s/api/ps answered %d", b.Host, resp.StatusCode)
+	}
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return models, err
+	}
+	err = json.Unmarshal(responseBody, &models)
+	return models, err
+}
+
+// check refreshes health and loaded models of the backend
+func (b *ollamaBackend) check() {
+	models, err := b.fetchPs(HEALTH_CHECK_TIMEOUT)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastCheck = time.Now()
+	if err != nil {
+		if b.healthy {
+			fmt.Printf("Ollama backend %s is down: %v\n", b.Host, err)
+		}
+		b.healthy = false
+		b.lastError = err.Error()
+		return
+	}
+	if !b.healthy {
+		fmt.Printf("Ollama backend %s is up\n", b.Host)
+	}
+	b.healthy = true
+	b.lastError = ""
+	b.loaded = make(map[string]bool)
+	for _, model := range models.Models {
+		b.loaded[model.Name] = true
+	}
+}
+
+func checkBackends() {
+	var wg sync.WaitGroup
+	for _, b := range backends {
+		wg.Add(1)
+		go func(b *ollamaBackend) {
+			defer wg.Done()
+			b.check()
+		}(b)
+	}
+	wg.Wait()
+}
+
+func runHealthChecks() {
+	for {
+		time.Sleep(HEALTH_CHECK_INTERVAL)
+		checkBackends()
+		maintainPins()
+	}
+}
+
+// healthyBackends returns the backends that passed their last check
+func healthyBackends() []*ollamaBackend {
+	var list []*ollamaBackend
+	for _, b := range backends {
+		if b.isHealthy() {
+			list = append(list, b)
+		}
+	}
+	return list
+}
+
+// pickBackend routes a request for a model: healthy backends which already
+// have the model loaded come first, ties are broken by the amount of requests
+// in flight. Backends in exclude, which already failed the request, are skipped.
+func pickBackend(model string, exclude map[string]bool) (*ollamaBackend, error) {
+	var best *ollamaBackend
+	bestLoaded, bestActive := false, 0
+	for _, b := range backends {
+		if exclude[b.Host] {
+			continue
+		}
+		b.mu.Lock()
+		healthy, loaded, active := b.healthy, b.loaded[model], b.active
+		b.mu.Unlock()
+		if !healthy {
+			continue
+		}
+		if best == nil || (loaded && !bestLoaded) || (loaded == bestLoaded && active < bestActive) {
+			best, bestLoaded, bestActive = b, loaded, active
+		}
+	}
+	if best == nil {
+		return nil, errNoBackend
+	}
+	return best, nil
+}
+
+// isTransportError tells whether err means the backend couldn't be talked
+// to at all, as opposed to Ollama answering with an error
+func isTransportError(err error) bool {
+	var statusErr *backendStatusError
+	return !errors.As(err, &statusErr)
+}
+
+type backendStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *backendStatusError) Error() string {
+	return fmt.Sprintf("external service answered %d: %s", e.StatusCode, e.Body)
+}
+
+// retryable tells whether a failed request is worth another backend: Ollama
+// rejecting the request itself with a 400 would be rejected everywhere
+func retryable(err error) bool {
+	var statusErr *backendStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode != http.StatusBadRequest
+	}
+	return true
+}
+
+// withFailover runs call against the backends able to serve the model until
+// one succeeds. Backends failing at the transport level are marked unhealthy
+// until their next health check.
+func withFailover(ctx context.Context, model string, call func(b *ollamaBackend) error) error {
+	tried := make(map[string]bool)
+	var lastErr error
+	for {
+		b, err := pickBackend(model, tried)
+		if err != nil {
+			if lastErr != nil {
+				return lastErr
+			}
+			return err
+		}
+		tried[b.Host] = true
+
+		b.acquire()
+		err = call(b)
+		b.release()
+		if err == nil || ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+		if isTransportError(err) {
+			b.markUnhealthy(err)
+		}
+		fmt.Printf("Ollama backend %s failed, failing over: %v\n", b.Host, err)
+		lastErr = err
+	}
+}
+
+// ollamaRequest performs a non-streamed request against a backend able to
+// serve the model and returns the response body
+func ollamaRequest(model string, method string, path string, body []byte, timeout time.Duration) ([]byte, error) {
+	var responseBody []byte
+	err := withFailover(context.Background(), model, func(b *ollamaBackend) error {
+		var err error
+		responseBody, err = ollamaRequestOn(b, method, path, body, timeout)
+		return err
+	})
+	return responseBody, err
+}
+
+func ollamaRequestOn(b *ollamaBackend, method string, path string, body []byte, timeout time.Duration) ([]byte, error) {
+	client := &http.Client{
+		Timeout: timeout,
+	}
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewBuffer(body)
+	}
+	req, err := http.NewRequest(method, b.Host+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &backendStatusError{StatusCode: resp.StatusCode, Body: string(responseBody)}
+	}
+	return responseBody, nil
+}
+
+// Handler for the /async/backends endpoint
+func backendsHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := getUserId(w, r)
+	if err != nil {
+		return
+	}
+
+	var statuses []BackendStatus
+	for _, b := range backends {
+		statuses = append(statuses, b.status())
+	}
+	jsonRes, err := json.Marshal(statuses)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonRes)
+}
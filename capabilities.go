@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ModelCapabilities is what /api/show tells about a model
+type ModelCapabilities struct {
+	Name          string                 `json:"name"`
+	Digest        string                 `json:"digest"`
+	Family        string                 `json:"family"`
+	ParameterSize string                 `json:"parameter_size"`
+	ContextLength int64                  `json:"context_length"`
+	Vision        bool                   `json:"vision"`
+	Tools         bool                   `json:"tools"`
+	Capabilities  []string               `json:"capabilities"`
+	Parameters    map[string]interface{} `json:"parameters"`
+	Template      string                 `json:"template"`
+	FetchedAt     time.Time              `json:"fetched_at"`
+}
+
+// answer of /api/show, limited to what is used
+type showAnswer struct {
+	Parameters    string                 `json:"parameters"`
+	Template      string                 `json:"template"`
+	Details       PsModelDetail          `json:"details"`
+	ModelInfo     map[string]interface{} `json:"model_info"`
+	ProjectorInfo map[string]interface{} `json:"projector_info"`
+	Capabilities  []string               `json:"capabilities"`
+}
+
+var errUnknownModel = errors.New("unknown model")
+
+// capabilities by model name
+var capabilityCache = struct {
+	sync.Mutex
+	m map[string]ModelCapabilities
+}{m: make(map[string]ModelCapabilities)}
+
+// parseParameters turns the "key value" lines of /api/show into a map.
+// Numbers are converted, keys given several times (like stop) become lists.
+func parseParameters(parameters string) map[string]interface{} {
+	parsed := make(map[string]interface{})
+	for _, line := range strings.Split(parameters, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), " ")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		var typed interface{} = value
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			typed = number
+		} else if unquoted, err := strconv.Unquote(value); err == nil {
+			typed = unquoted
+		}
+		switch existing := parsed[key].(type) {
+		case nil:
+			parsed[key] = typed
+		case []interface{}:
+			parsed[key] = append(existing, typed)
+		default:
+			parsed[key] = []interface{}{existing, typed}
+		}
+	}
+	return parsed
+}
+
+func hasCapability(capabilities []string, capability string) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchCapabilities calls /api/show. Older Ollama versions don't report
+// capabilities, so vision and tools are also guessed from model info and
+// template.
+func fetchCapabilities(model string, digest string) (ModelCapabilities, error) {
+	caps := ModelCapabilities{Name: model, Digest: digest, FetchedAt: time.Now()}
+
+	body, err := json.Marshal(map[string]string{"model": model})
+	if err != nil {
+		return caps, err
+	}
+	responseBody, err := ollamaRequest(model, "POST", "/api/show", body, time.Minute)
+	if err != nil {
+		var statusErr *backendStatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			return caps, errUnknownModel
+		}
+		return caps, err
+	}
+	var show showAnswer
+	err = json.Unmarshal(responseBody, &show)
+	if err != nil {
+		return caps, err
+	}
+
+	caps.Family = show.Details.Family
+	caps.ParameterSize = show.Details.ParameterSize
+	caps.Template = show.Template
+	caps.Parameters = parseParameters(show.Parameters)
+	caps.Capabilities = show.Capabilities
+	if caps.Capabilities == nil {
+		caps.Capabilities = []string{}
+	}
+
+	architecture, _ := show.ModelInfo["general.architecture"].(string)
+	for key, value := range show.ModelInfo {
+		if key == architecture+".context_length" || (architecture == "" && strings.HasSuffix(key, ".context_length")) {
+			if length, ok := value.(float64); ok {
+				caps.ContextLength = int64(length)
+			}
+		}
+		if strings.Contains(key, ".vision.") {
+			caps.Vision = true
+		}
+	}
+	caps.Vision = caps.Vision || len(show.ProjectorInfo) > 0 || hasCapability(show.Capabilities, "vision")
+	caps.Tools = hasCapability(show.Capabilities, "tools") || strings.Contains(show.Template, ".Tools")
+	return caps, nil
+}
+
+// getCapabilities returns the cached capabilities of a model, fetching them
+// if the model is unknown to the cache or its digest changed. An empty
+// digest accepts whatever is cached.
+func getCapabilities(model string, digest string) (ModelCapabilities, error) {
+	capabilityCache.Lock()
+	caps, ok := capabilityCache.m[model]
+	capabilityCache.Unlock()
+	if ok && (digest == "" || caps.Digest == digest) {
+		return caps, nil
+	}
+
+	caps, err := fetchCapabilities(model, digest)
+	if err != nil {
+		return caps, err
+	}
+	capabilityCache.Lock()
+	capabilityCache.m[model] = caps
+	capabilityCache.Unlock()
+	return caps, nil
+}
+
+// forgetCapabilities drops a model from the cache, e.g. after a pull
+func forgetCapabilities(model string) {
+	capabilityCache.Lock()
+	delete(capabilityCache.m, model)
+	capabilityCache.Unlock()
+}
+
+// validatePayload checks a chat request against the capabilities of its
+// model before it gets queued. Models which can't be looked up because no
+// backend answers are let through, the queue will deal with them.
+func validatePayload(payload Payload) error {
+	if payload.Model == "" {
+		return errors.New("no model given")
+	}
+	if len(payload.Messages) == 0 {
+		return errors.New("no messages given")
+	}
+	if !validKeepAlive(payload.KeepAlive) {
+		return errors.New("keep_alive must be seconds or a duration like \"10m\"")
+	}
+	if hasFormat(payload.Format) {
+		if _, err := parseFormat(payload.Format); err != nil {
+			return err
+		}
+	}
+	caps, err := getCapabilities(payload.Model, "")
+	if err == errUnknownModel {
+		return fmt.Errorf("unknown model %s", payload.Model)
+	}
+	if err != nil {
+		fmt.Printf("Failed to get capabilities of %s: %v\n", payload.Model, err)
+		return nil
+	}
+
+	if hasImages(payload.Messages) && !caps.Vision {
+		return fmt.Errorf("%s can't read images", payload.Model)
+	}
+	if payload.UseTools && !caps.Tools {
+		return fmt.Errorf("%s can't call tools", payload.Model)
+	}
+
+	contextLength := caps.ContextLength
+	if payload.Options != nil && payload.Options.NumCtx != nil {
+		numCtx := int64(*payload.Options.NumCtx)
+		if numCtx <= 0 || (contextLength > 0 && numCtx > contextLength) {
+			return fmt.Errorf("num_ctx must be between 1 and the context length of %s (%d tokens)", payload.Model, contextLength)
+		}
+		contextLength = numCtx
+	}
+
+	tokens := messageTokens(payload.Messages)
+	if contextLength > 0 && int64(tokens) > contextLength {
+		return fmt.Errorf("the messages (about %d tokens) exceed the context length of %s (%d tokens)", tokens, payload.Model, contextLength)
+	}
+	return nil
+}
+
+// Handler for the /async/capabilities endpoint, listing the capabilities of
+// every model from /async/tags, or only of ?model=<name>
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := getUserId(w, r)
+	if err != nil {
+		return
+	}
+
+	tags, err := getModelTags()
+	if err != nil {
+		fmt.Printf("Failed to make tags request to external service: %v", err)
+		http.Error(w, "Failed to list models", http.StatusBadGateway)
+		return
+	}
+
+	only := r.URL.Query().Get("model")
+	list := []ModelCapabilities{}
+	for _, model := range tags.Models {
+		if only != "" && model.Name != only {
+			continue
+		}
+		caps, err := getCapabilities(model.Name, model.Digest)
+		if err != nil {
+			fmt.Printf("Failed to get capabilities of %s: %v\n", model.Name, err)
+			continue
+		}
+		list = append(list, caps)
+	}
+
+	jsonRes, err := json.Marshal(list)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonRes)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// logChatTurn stores a message of a job in chat_log, the server-side
+// equivalent of /async/storeChatLog. A job logs each role at most once, so a
+// job which runs again after a restart doesn't duplicate its answer.
+func logChatTurn(db *sql.DB, userId int, conversationId int, uuid string, model string, message Messages) error {
+	_, err := db.Exec(`INSERT INTO chat_log (user_id, persona, role, content, images, job_uuid, model, conversation_id, datetime)
+		SELECT ?, ?, ?, ?, ?, ?, ?, ?, ? FROM DUAL
+		WHERE NOT EXISTS (SELECT 1 FROM chat_log WHERE job_uuid = ? AND role = ?)`,
+		userId, message.Persona, message.Role, message.Content, marshalImages(message.Images), uuid, model, conversationParam(conversationId), time.Now(),
+		uuid, message.Role)
+	touchConversation(db, conversationId)
+	return err
+}
+
+// assistantPersona is the name the answer of a chat request is logged
+// under: the persona of its system message, or else the model
+func assistantPersona(payload Payload) string {
+	for _, message := range payload.Messages {
+		if message.Role == "system" && message.Persona != "" {
+			return message.Persona
+		}
+	}
+	return payload.Model
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// context window used for assembled prompts when the request doesn't set
+// num_ctx, unless the model has less
+const DEFAULT_NUM_CTX = 8192
+
+// share of the context window kept free for the answer when the request
+// doesn't set num_predict
+const ANSWER_SHARE = 4
+
+// contextBudget returns the context window for an assembled prompt and the
+// amount of tokens the prompt may use of it, which the CONTEXT_BUDGET
+// environment variable may lower further
+func contextBudget(payload Payload) (int, int) {
+	numCtx := 0
+	if payload.Options != nil && payload.Options.NumCtx != nil {
+		numCtx = *payload.Options.NumCtx
+	}
+	if numCtx <= 0 {
+		numCtx = DEFAULT_NUM_CTX
+		caps, err := getCapabilities(payload.Model, "")
+		if err == nil && caps.ContextLength > 0 && caps.ContextLength < int64(numCtx) {
+			numCtx = int(caps.ContextLength)
+		}
+	}
+	reserve := numCtx / ANSWER_SHARE
+	if payload.Options != nil && payload.Options.NumPredict != nil && *payload.Options.NumPredict > 0 {
+		reserve = *payload.Options.NumPredict
+	}
+	budget := numCtx - reserve
+	if configured, err := strconv.Atoi(os.Getenv("CONTEXT_BUDGET")); err == nil && configured > 0 && configured < budget {
+		budget = configured
+	}
+	return numCtx, budget
+}
+
+// context tokens an image is estimated at, vision models take a few hundred
+// up to a few thousand
+const IMAGE_TOKENS = 768
+
+func turnTokens(message Messages) int {
+	return estimateTokens(message.Content) + len(message.Images)*IMAGE_TOKENS
+}
+
+func messageTokens(messages []Messages) int {
+	tokens := 0
+	for _, message := range messages {
+		tokens += turnTokens(message)
+	}
+	return tokens
+}
+
+// turnsAfter returns the user and assistant turns of a conversation after
+// the given chat_log id, oldest first
+func turnsAfter(db *sql.DB, userId int, conversationId int, afterId int) ([]Messages, error) {
+	rows, err := db.Query("SELECT id, persona, role, content, images FROM chat_log WHERE user_id = ? AND conversation_id <=> ? AND id > ? AND role IN ('user', 'assistant') ORDER BY id", userId, conversationParam(conversationId), afterId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var turns []Messages
+	for rows.Next() {
+		var turn Messages
+		var images sql.NullString
+		err = rows.Scan(&turn.Id, &turn.Persona, &turn.Role, &turn.Content, &images)
+		if err != nil {
+			return nil, err
+		}
+		turn.Images = unmarshalImages(images)
+		turns = append(turns, turn)
+	}
+	return turns, rows.Err()
+}
+
+// fitTurns returns the index of the oldest turn from which on the turns fit
+// into budget tokens
+func fitTurns(turns []Messages, budget int) int {
+	first := len(turns)
+	for first > 0 {
+		tokens := turnTokens(turns[first-1])
+		if tokens > budget {
+			break
+		}
+		budget -= tokens
+		first--
+	}
+	return first
+}
+
+// errSummaryFailed is returned when the conversation needed summarizing but
+// the summarizer failed
+var errSummaryFailed = errors.New("failed to summarize the conversation")
+
+// assembleContext builds the messages of a request which only carries the
+// new message: the system prompt already in place (from the persona), the
+// rolling summary of the conversation, and the turns after it. Should the
+// turns not fit into the context window anymore, the oldest ones are folded
+// into the summary first; no turn is left out without being summarized.
+// reserve tokens are kept free for what is added to the prompt afterwards.
+func assembleContext(db *sql.DB, userId int, payload *Payload, reserve int) error {
+	message := *payload.Message
+	if message.Role == "" {
+		message.Role = "user"
+	}
+	numCtx, budget := contextBudget(*payload)
+	budget -= messageTokens(payload.Messages) + turnTokens(message) + reserve
+	if budget < 0 {
+		return fmt.Errorf("the message (about %d tokens) doesn't fit into the context window of %d tokens", turnTokens(message)+reserve, numCtx)
+	}
+
+	summary, err := loadRollingSummary(db, userId, payload.ConversationId)
+	if err != nil {
+		return err
+	}
+	turns, err := turnsAfter(db, userId, payload.ConversationId, summary.LastId)
+	if err != nil {
+		return err
+	}
+
+	if first := fitTurns(turns, budget-summary.tokens()); first > 0 {
+		summary, turns, err = rollConversation(db, userId, payload.ConversationId, first, budget)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errSummaryFailed, err)
+		}
+		if fitTurns(turns, budget-summary.tokens()) > 0 {
+			return fmt.Errorf("the conversation doesn't fit into the context window of %d tokens, even summarized", numCtx)
+		}
+	}
+
+	if summary.Content != "" {
+		payload.Messages = append(payload.Messages, summary.message())
+	}
+	payload.Messages = append(payload.Messages, turns...)
+	payload.Messages = append(payload.Messages, message)
+
+	// the budget only holds if Ollama uses the same window
+	if payload.Options == nil {
+		payload.Options = &ModelOptions{}
+	}
+	payload.Options.NumCtx = &numCtx
+	payload.Message = nil
+	// the assembled history is read back from chat_log
+	payload.LogChat = true
+	return nil
+}
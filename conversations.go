@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Conversation is a chat thread. chat_log rows and memories written before
+// conversations existed have none, they make up conversation 0.
+type Conversation struct {
+	Id        int       `json:"id"`
+	Title     string    `json:"title"`
+	Archived  bool      `json:"archived"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ConversationUpdate renames and/or (un)archives a conversation
+type ConversationUpdate struct {
+	Title    *string `json:"title"`
+	Archived *bool   `json:"archived"`
+}
+
+// conversationParam is the query argument matching a conversation with
+// "conversation_id <=> ?": NULL for conversation 0
+func conversationParam(conversationId int) interface{} {
+	if conversationId == 0 {
+		return nil
+	}
+	return conversationId
+}
+
+func loadConversation(db *sql.DB, userId int, conversationId int) (Conversation, error) {
+	var conversation Conversation
+	err := db.QueryRow("SELECT id, title, archived, created_at, updated_at FROM conversations WHERE id = ? AND user_id = ?", conversationId, userId).
+		Scan(&conversation.Id, &conversation.Title, &conversation.Archived, &conversation.CreatedAt, &conversation.UpdatedAt)
+	return conversation, err
+}
+
+// ownsConversation tells whether the conversation belongs to the user.
+// Conversation 0 belongs to everyone.
+func ownsConversation(db *sql.DB, userId int, conversationId int) bool {
+	if conversationId == 0 {
+		return true
+	}
+	_, err := loadConversation(db, userId, conversationId)
+	return err == nil
+}
+
+// requestConversation reads the ?conversation_id= of a request, answering
+// 404 if it isn't a conversation of the user
+func requestConversation(w http.ResponseWriter, r *http.Request, db *sql.DB, userId int) (int, bool) {
+	value := r.URL.Query().Get("conversation_id")
+	if value == "" {
+		return 0, true
+	}
+	conversationId, err := strconv.Atoi(value)
+	if err != nil {
+		http.Error(w, "Invalid conversation id", http.StatusBadRequest)
+		return 0, false
+	}
+	if !ownsConversation(db, userId, conversationId) {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return 0, false
+	}
+	return conversationId, true
+}
+
+// touchConversation moves a conversation to the top of the list
+func touchConversation(db *sql.DB, conversationId int) {
+	if conversationId == 0 {
+		return
+	}
+	_, err := db.Exec("UPDATE conversations SET updated_at = ? WHERE id = ?", time.Now(), conversationId)
+	if err != nil {
+		fmt.Printf("Failed to update conversation %d: %v", conversationId, err)
+	}
+}
+
+// Handler for the /async/conversations endpoint: GET lists the conversations
+// of the user, most recent first and without the archived ones unless
+// ?archived=1, POST creates one
+func conversationsHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := getUserId(w, r)
+	if err != nil {
+		return
+	}
+	db, _ := getDb()
+	defer db.Close()
+
+	switch r.Method {
+	case http.MethodGet:
+		query := "SELECT id, title, archived, created_at, updated_at FROM conversations WHERE user_id = ? AND archived = 0 ORDER BY updated_at DESC"
+		if r.URL.Query().Get("archived") == "1" {
+			query = "SELECT id, title, archived, created_at, updated_at FROM conversations WHERE user_id = ? ORDER BY updated_at DESC"
+		}
+		rows, err := db.Query(query, userId)
+		if err != nil {
+			fmt.Printf("Failed to list conversations: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		conversations := []Conversation{}
+		for rows.Next() {
+			var conversation Conversation
+			err = rows.Scan(&conversation.Id, &conversation.Title, &conversation.Archived, &conversation.CreatedAt, &conversation.UpdatedAt)
+			if err != nil {
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			conversations = append(conversations, conversation)
+		}
+		writeJSON(w, conversations)
+
+	case http.MethodPost:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+			return
+		}
+		defer r.Body.Close()
+		var conversation Conversation
+		err = json.Unmarshal(body, &conversation)
+		if err != nil {
+			http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		result, err := db.Exec("INSERT INTO conversations (user_id, title, archived, created_at, updated_at) VALUES (?, ?, 0, ?, ?)", userId, conversation.Title, now, now)
+		if err != nil {
+			fmt.Printf("Failed to create conversation: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		id, _ := result.LastInsertId()
+		conversation = Conversation{Id: int(id), Title: conversation.Title, CreatedAt: now, UpdatedAt: now}
+		writeJSON(w, conversation)
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Handler for the /async/conversation?id=<id> endpoint: GET returns the
+// conversation, PATCH renames and/or archives it, DELETE removes it along
+// with its chat log, memories and summary
+func conversationHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := getUserId(w, r)
+	if err != nil {
+		return
+	}
+	conversationId, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid conversation id", http.StatusBadRequest)
+		return
+	}
+	db, _ := getDb()
+	defer db.Close()
+
+	conversation, err := loadConversation(db, userId, conversationId)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, conversation)
+
+	case http.MethodPatch:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+			return
+		}
+		defer r.Body.Close()
+		var update ConversationUpdate
+		err = json.Unmarshal(body, &update)
+		if err != nil {
+			http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+			return
+		}
+		if update.Title != nil {
+			conversation.Title = *update.Title
+		}
+		if update.Archived != nil {
+			conversation.Archived = *update.Archived
+		}
+		conversation.UpdatedAt = time.Now()
+		_, err = db.Exec("UPDATE conversations SET title = ?, archived = ?, updated_at = ? WHERE id = ?", conversation.Title, conversation.Archived, conversation.UpdatedAt, conversationId)
+		if err != nil {
+			fmt.Printf("Failed to update conversation: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, conversation)
+
+	case http.MethodDelete:
+		// The embeddings of the memories stay in the external memory service,
+		// which offers no way to delete them. They are harmless: retrieval is
+		// scoped to a conversation id, which is never handed out again, and
+		// retrieveMemoryById only returns memories still in the database.
+		for _, statement := range []string{
+			"DELETE FROM chat_log WHERE conversation_id = ?",
+			"DELETE FROM memories WHERE conversation_id = ?",
+			"DELETE FROM conversation_summaries WHERE conversation_id = ?",
+			"DELETE FROM conversations WHERE id = ?",
+		} {
+			_, err = db.Exec(statement, conversationId)
+			if err != nil {
+				fmt.Printf("Failed to delete conversation: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		http.Error(w, "Only GET, PATCH and DELETE methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
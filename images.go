@@ -0,0 +1,74 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// normalizeImages turns the images of a message into the plain base64 Ollama
+// expects, stripping data URL prefixes like "data:image/png;base64,"
+func normalizeImages(images []string) ([]string, error) {
+	var normalized []string
+	for i, image := range images {
+		if strings.HasPrefix(image, "data:") {
+			_, data, found := strings.Cut(image, ",")
+			if !found {
+				return nil, fmt.Errorf("image %d is an invalid data URL", i+1)
+			}
+			image = data
+		}
+		image = strings.TrimSpace(image)
+		if _, err := base64.StdEncoding.DecodeString(image); err != nil {
+			return nil, fmt.Errorf("image %d is not base64 encoded: %v", i+1, err)
+		}
+		normalized = append(normalized, image)
+	}
+	return normalized, nil
+}
+
+// normalizeMessageImages normalizes the images of every message in place
+func normalizeMessageImages(messages []Messages) error {
+	for i := range messages {
+		if len(messages[i].Images) == 0 {
+			continue
+		}
+		images, err := normalizeImages(messages[i].Images)
+		if err != nil {
+			return err
+		}
+		messages[i].Images = images
+	}
+	return nil
+}
+
+func hasImages(messages []Messages) bool {
+	for _, message := range messages {
+		if len(message.Images) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// images are stored in chat_log as a JSON array, NULL for none
+func marshalImages(images []string) sql.NullString {
+	if len(images) == 0 {
+		return sql.NullString{}
+	}
+	encoded, err := json.Marshal(images)
+	if err != nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: string(encoded), Valid: true}
+}
+
+func unmarshalImages(stored sql.NullString) []string {
+	var images []string
+	if stored.Valid && stored.String != "" {
+		json.Unmarshal([]byte(stored.String), &images)
+	}
+	return images
+}
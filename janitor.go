@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// how long finished jobs nobody fetched stay in the async table, unless
+// overridden by the JOB_TTL environment variable (e.g. "6h")
+const DEFAULT_JOB_TTL = 24 * time.Hour
+
+const JANITOR_INTERVAL = 10 * time.Minute
+
+type JanitorStats struct {
+	TTL          string         `json:"ttl"`
+	LastRun      *time.Time     `json:"last_run,omitempty"`
+	LastRemoved  map[string]int `json:"last_removed"`
+	TotalRemoved map[string]int `json:"total_removed"`
+}
+
+var janitor = struct {
+	sync.Mutex
+	stats JanitorStats
+}{stats: JanitorStats{LastRemoved: map[string]int{}, TotalRemoved: map[string]int{}}}
+
+func jobTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("JOB_TTL"))
+	if err != nil || ttl <= 0 {
+		return DEFAULT_JOB_TTL
+	}
+	return ttl
+}
+
+func runJanitor() {
+	for {
+		purgeFinishedJobs()
+		time.Sleep(JANITOR_INTERVAL)
+	}
+}
+
+// purgeFinishedJobs removes the finished jobs whose answer hasn't been fetched
+// within the TTL. Rows finished before finished_at existed are removed too.
+func purgeFinishedJobs() {
+	db, _ := getDb()
+	defer db.Close()
+
+	ttl := jobTTL()
+	limit := time.Now().Add(-ttl)
+	removed := map[string]int{}
+
+	for _, state := range []string{JOB_DONE, JOB_FAILED, JOB_CANCELLED} {
+		result, err := db.Exec("DELETE FROM async WHERE status = ? AND (finished_at < ? OR finished_at IS NULL)", state, limit)
+		if err != nil {
+			fmt.Printf("Failed to purge %s jobs: %v", state, err)
+			continue
+		}
+		count, _ := result.RowsAffected()
+		removed[state] = int(count)
+	}
+	_, err := db.Exec("DELETE FROM job_steps WHERE job_uuid NOT IN (SELECT uuid FROM async)")
+	if err != nil {
+		fmt.Printf("Failed to purge job steps: %v", err)
+	}
+
+	now := time.Now()
+	janitor.Lock()
+	janitor.stats.TTL = ttl.String()
+	janitor.stats.LastRun = &now
+	janitor.stats.LastRemoved = removed
+	for state, count := range removed {
+		janitor.stats.TotalRemoved[state] += count
+	}
+	janitor.Unlock()
+
+	if removed[JOB_DONE]+removed[JOB_FAILED]+removed[JOB_CANCELLED] > 0 {
+		fmt.Printf("Janitor removed %d done, %d failed and %d cancelled job(s)\n", removed[JOB_DONE], removed[JOB_FAILED], removed[JOB_CANCELLED])
+	}
+}
+
+// Handler for the /async/janitor endpoint
+func janitorHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := getUserId(w, r)
+	if err != nil {
+		return
+	}
+
+	janitor.Lock()
+	jsonRes, err := json.Marshal(janitor.stats)
+	janitor.Unlock()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonRes)
+}
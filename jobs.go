@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// lifecycle states of the rows of the async table
+const (
+	JOB_QUEUED    = "queued"
+	JOB_RUNNING   = "running"
+	JOB_DONE      = "done"
+	JOB_FAILED    = "failed"
+	JOB_CANCELLED = "cancelled"
+)
+
+// JobStatus is returned by /async/response. The LLMAnswer fields stay at the
+// top level, so clients only looking at model and message keep working.
+type JobStatus struct {
+	LLMAnswer
+	UniqueID   string     `json:"uniqueID"`
+	State      string     `json:"state"`
+	Error      string     `json:"error,omitempty"`
+	QueuedAt   *time.Time `json:"queued_at,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Steps      []JobStep  `json:"steps,omitempty"` // tool calls made for the answer
+}
+
+type CancelResult struct {
+	UniqueID  string `json:"uniqueID"`
+	Cancelled bool   `json:"cancelled"`
+}
+
+// cancel functions of the chat jobs currently talking to Ollama, by uuid
+var runningJobs = struct {
+	sync.Mutex
+	m map[string]context.CancelFunc
+}{m: make(map[string]context.CancelFunc)}
+
+// registerJob returns a context for the job's upstream request, which is
+// cancelled by cancelJob or once the job calls the returned release func.
+func registerJob(uuid string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	runningJobs.Lock()
+	runningJobs.m[uuid] = cancel
+	runningJobs.Unlock()
+	return ctx, func() {
+		runningJobs.Lock()
+		delete(runningJobs.m, uuid)
+		runningJobs.Unlock()
+		cancel()
+	}
+}
+
+func cancelJob(uuid string) bool {
+	runningJobs.Lock()
+	cancel, ok := runningJobs.m[uuid]
+	runningJobs.Unlock()
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// markJobRunning claims a queued job, returns false if it isn't queued anymore
+func markJobRunning(uuid string) (bool, error) {
+	db, _ := getDb()
+	defer db.Close()
+	result, err := db.Exec("UPDATE async SET status = ?, started_at = ?, attempts = attempts + 1 WHERE uuid = ? AND status = ?", JOB_RUNNING, time.Now(), uuid, JOB_QUEUED)
+	if err != nil {
+		return false, err
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+// markJobDone returns false if the job isn't running anymore, e.g. because
+// it has been cancelled meanwhile
+func markJobDone(uuid string, answer string) (bool, error) {
+	db, _ := getDb()
+	defer db.Close()
+	result, err := db.Exec("UPDATE async SET status = ?, answer = ?, finished_at = ? WHERE uuid = ? AND status = ?", JOB_DONE, answer, time.Now(), uuid, JOB_RUNNING)
+	if err != nil {
+		return false, err
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+// markJobFailed returns false if the job has already reached a final state
+func markJobFailed(uuid string, errMsg string) (bool, error) {
+	db, _ := getDb()
+	defer db.Close()
+	result, err := db.Exec("UPDATE async SET status = ?, error = ?, finished_at = ? WHERE uuid = ? AND status IN (?, ?)", JOB_FAILED, errMsg, time.Now(), uuid, JOB_QUEUED, JOB_RUNNING)
+	if err != nil {
+		return false, err
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+// markJobCancelled returns false if the job doesn't belong to the user or
+// has already reached a final state
+func markJobCancelled(uuid string, userId int) (bool, error) {
+	db, _ := getDb()
+	defer db.Close()
+	result, err := db.Exec("UPDATE async SET status = ?, finished_at = ? WHERE uuid = ? AND user_id = ? AND status IN (?, ?)", JOB_CANCELLED, time.Now(), uuid, userId, JOB_QUEUED, JOB_RUNNING)
+	if err != nil {
+		return false, err
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+// loadJobStatus reads a job from the async table. Returns sql.ErrNoRows for
+// unknown jobs.
+func loadJobStatus(db *sql.DB, uuid string) (JobStatus, error) {
+	var status JobStatus
+	var answer, errMsg sql.NullString
+	var queuedAt, startedAt, finishedAt sql.NullTime
+	err := db.QueryRow("SELECT status, answer, error, queued_at, started_at, finished_at FROM async WHERE uuid = ?", uuid).Scan(&status.State, &answer, &errMsg, &queuedAt, &startedAt, &finishedAt)
+	if err != nil {
+		return status, err
+	}
+	status.UniqueID = uuid
+	status.Error = errMsg.String
+	if queuedAt.Valid {
+		status.QueuedAt = &queuedAt.Time
+	}
+	if startedAt.Valid {
+		status.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		status.FinishedAt = &finishedAt.Time
+	}
+
+	status.Steps, err = loadJobSteps(db, uuid)
+	if err != nil {
+		return status, fmt.Errorf("failed to load steps: %v", err)
+	}
+
+	switch status.State {
+	case JOB_DONE:
+		err = json.Unmarshal([]byte(answer.String), &status.LLMAnswer)
+		if err != nil {
+			return status, fmt.Errorf("failed to unmarshal answer: %v", err)
+		}
+	case JOB_QUEUED, JOB_RUNNING:
+		status.Model = "still processing"
+	default:
+		status.Model = status.State
+	}
+	return status, nil
+}
+
+func isFinalState(state string) bool {
+	return state == JOB_DONE || state == JOB_FAILED || state == JOB_CANCELLED
+}
+
+// finalStatus is the status of a job reaching a final state, the way
+// /async/response returns it
+func finalStatus(job *chatJob, state string, answer *LLMAnswer, errMsg string) JobStatus {
+	finishedAt := time.Now()
+	status := JobStatus{UniqueID: job.UUID, State: state, Error: errMsg, FinishedAt: &finishedAt}
+	if !job.QueuedAt.IsZero() {
+		status.QueuedAt = &job.QueuedAt
+	}
+	if !job.StartedAt.IsZero() {
+		status.StartedAt = &job.StartedAt
+	}
+	if answer != nil {
+		status.LLMAnswer = *answer
+	} else {
+		status.Model = state
+	}
+	if job.Payload.UseTools {
+		db, _ := getDb()
+		defer db.Close()
+		steps, err := loadJobSteps(db, job.UUID)
+		if err != nil {
+			fmt.Printf("Failed to load steps of job %s: %v", job.UUID, err)
+		}
+		status.Steps = steps
+	}
+	return status
+}
+
+// jobCallback prepares the webhook of a job reaching a final state, and
+// returns the func sending it once the state is stored. The status is built
+// beforehand, as /async/response deletes the job as soon as it is final.
+func jobCallback(job *chatJob, state string, answer *LLMAnswer, errMsg string) func() {
+	if job == nil || job.Payload.CallbackURL == "" {
+		return func() {}
+	}
+	status := finalStatus(job, state, answer, errMsg)
+	return func() {
+		go notifyWebhook(job.Payload.CallbackURL, status)
+	}
+}
+
+// cancelChatJob cancels a queued or running job of the user, returns false
+// if there is no such job
+func cancelChatJob(uuid string, userId int) (bool, error) {
+	notify := jobCallback(queue.find(uuid), JOB_CANCELLED, nil, "")
+	cancelled, err := markJobCancelled(uuid, userId)
+	if err != nil || !cancelled {
+		return false, err
+	}
+	notify()
+	if !cancelJob(uuid) {
+		if job := queue.remove(uuid); job != nil {
+			job.stream.finish(uuid, nil, JOB_CANCELLED)
+		}
+	}
+	return true, nil
+}
+
+// Handler for the /async/cancel endpoint
+func cancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userId, err := getUserId(w, r)
+	if err != nil {
+		return
+	}
+
+	uid := r.URL.Query().Get("uid")
+
+	cancelled, err := cancelChatJob(uid, userId)
+	if err != nil {
+		fmt.Printf("Failed to cancel job %s: %v", uid, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !cancelled {
+		http.Error(w, "No pending job with this id", http.StatusNotFound)
+		return
+	}
+
+	jsonRes, _ := json.Marshal(CancelResult{UniqueID: uid, Cancelled: true})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonRes)
+}
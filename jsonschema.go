@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// amount of answers asked for when the model keeps answering JSON which
+// doesn't validate against the requested format
+const MAX_FORMAT_ATTEMPTS = 3
+
+// jsonSchema is the subset of JSON schema which is checked: types, enum and
+// const, object properties, required and additionalProperties, array items
+// and the usual length and range keywords. Other keywords are ignored.
+type jsonSchema struct {
+	Type                 interface{}            `json:"type"`
+	Enum                 []interface{}          `json:"enum"`
+	Const                interface{}            `json:"const"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties interface{}            `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+}
+
+// hasFormat tells whether a request asks for a format at all
+func hasFormat(format json.RawMessage) bool {
+	return len(format) > 0 && string(format) != "null"
+}
+
+// parseFormat reads the format of a request, which is either the string
+// "json" (any JSON will do) or a JSON schema. It returns a nil schema for
+// "json".
+func parseFormat(format json.RawMessage) (*jsonSchema, error) {
+	var name string
+	if json.Unmarshal(format, &name) == nil {
+		if name != "json" {
+			return nil, fmt.Errorf("unknown format %q", name)
+		}
+		return nil, nil
+	}
+	var schema jsonSchema
+	err := json.Unmarshal(format, &schema)
+	if err != nil {
+		return nil, fmt.Errorf("format is neither \"json\" nor a JSON schema: %v", err)
+	}
+	return &schema, nil
+}
+
+// validateFormat checks that an answer is JSON matching the format
+func validateFormat(format json.RawMessage, answer string) error {
+	schema, err := parseFormat(format)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(strings.NewReader(answer))
+	decoder.UseNumber()
+	var value interface{}
+	err = decoder.Decode(&value)
+	if err != nil {
+		return fmt.Errorf("the answer is not valid JSON: %v", err)
+	}
+	if decoder.More() {
+		return errors.New("the answer contains more than one JSON value")
+	}
+	if schema == nil {
+		return nil
+	}
+	return schema.validate(value, "$")
+}
+
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func (s *jsonSchema) allowsType(actual string) bool {
+	var allowed []string
+	switch t := s.Type.(type) {
+	case nil:
+		return true
+	case string:
+		allowed = []string{t}
+	case []interface{}:
+		for _, name := range t {
+			if name, ok := name.(string); ok {
+				allowed = append(allowed, name)
+			}
+		}
+	}
+	for _, name := range allowed {
+		if name == actual || (name == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// sameJSON compares a decoded value with one from the schema, where numbers
+// are float64 instead of json.Number
+func sameJSON(value interface{}, expected interface{}) bool {
+	var a, b interface{}
+	encoded, _ := json.Marshal(value)
+	json.Unmarshal(encoded, &a)
+	encoded, _ = json.Marshal(expected)
+	json.Unmarshal(encoded, &b)
+	return reflect.DeepEqual(a, b)
+}
+
+func (s *jsonSchema) validate(value interface{}, path string) error {
+	actual := jsonType(value)
+	if !s.allowsType(actual) {
+		return fmt.Errorf("%s: expected %v, got %s", path, s.Type, actual)
+	}
+	if s.Enum != nil {
+		found := false
+		for _, allowed := range s.Enum {
+			if sameJSON(value, allowed) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value is not one of %v", path, s.Enum)
+		}
+	}
+	if s.Const != nil && !sameJSON(value, s.Const) {
+		return fmt.Errorf("%s: value must be %v", path, s.Const)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+		for name, property := range v {
+			if schema, ok := s.Properties[name]; ok {
+				if err := schema.validate(property, path+"."+name); err != nil {
+					return err
+				}
+				continue
+			}
+			switch additional := s.AdditionalProperties.(type) {
+			case bool:
+				if !additional {
+					return fmt.Errorf("%s: unexpected property %q", path, name)
+				}
+			case map[string]interface{}:
+				encoded, _ := json.Marshal(additional)
+				var schema jsonSchema
+				if json.Unmarshal(encoded, &schema) == nil {
+					if err := schema.validate(property, path+"."+name); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fmt.Errorf("%s: expected at least %d items, got %d", path, *s.MinItems, len(v))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fmt.Errorf("%s: expected at most %d items, got %d", path, *s.MaxItems, len(v))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := len([]rune(v))
+		if s.MinLength != nil && length < *s.MinLength {
+			return fmt.Errorf("%s: expected at least %d characters", path, *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return fmt.Errorf("%s: expected at most %d characters", path, *s.MaxLength)
+		}
+	case json.Number:
+		number, err := v.Float64()
+		if err != nil || math.IsInf(number, 0) {
+			return fmt.Errorf("%s: invalid number %s", path, v)
+		}
+		if s.Minimum != nil && number < *s.Minimum {
+			return fmt.Errorf("%s: %s is below the minimum of %v", path, v, *s.Minimum)
+		}
+		if s.Maximum != nil && number > *s.Maximum {
+			return fmt.Errorf("%s: %s is above the maximum of %v", path, v, *s.Maximum)
+		}
+	}
+	return nil
+}
+
+// correctionPrompt asks the model to fix an answer which failed validation
+func correctionPrompt(err error) string {
+	return fmt.Sprintf("Your answer does not match the requested JSON format: %v. Answer again with only the corrected JSON, without any explanation.", err)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidateFormat(t *testing.T) {
+	person := `{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0},
+			"height": {"type": "number"},
+			"role": {"enum": ["admin", "user"]},
+			"tags": {"type": "array", "maxItems": 2, "items": {"type": "string"}},
+			"pets": {
+				"type": "array",
+				"items": {
+					"type": "object",
+					"properties": {"kind": {"type": "string"}},
+					"required": ["kind"],
+					"additionalProperties": false
+				}
+			}
+		},
+		"required": ["name", "age"],
+		"additionalProperties": false
+	}`
+
+	tests := []struct {
+		name   string
+		format string
+		answer string
+		valid  bool
+	}{
+		{"any json", `"json"`, `{"a": [1, 2]}`, true},
+		{"any json, not json", `"json"`, `not json`, false},
+		{"two values", `"json"`, `{} {}`, false},
+		{"unknown format", `"xml"`, `{}`, false},
+
+		{"valid object", person, `{"name": "Ann", "age": 31}`, true},
+		{"all properties", person, `{"name": "Ann", "age": 31, "height": 1.7, "role": "admin", "tags": ["a"], "pets": [{"kind": "cat"}]}`, true},
+		{"string instead of object", person, `"Ann"`, false},
+		{"number instead of string", person, `{"name": 3, "age": 31}`, false},
+		{"string instead of integer", person, `{"name": "Ann", "age": "31"}`, false},
+		{"null instead of integer", person, `{"name": "Ann", "age": null}`, false},
+
+		{"enum match", person, `{"name": "Ann", "age": 31, "role": "user"}`, true},
+		{"enum mismatch", person, `{"name": "Ann", "age": 31, "role": "root"}`, false},
+
+		{"missing required", person, `{"name": "Ann"}`, false},
+		{"additional property", person, `{"name": "Ann", "age": 31, "email": "ann@example.com"}`, false},
+
+		{"nested items", person, `{"name": "Ann", "age": 31, "pets": [{"kind": "cat"}, {"kind": "dog"}]}`, true},
+		{"nested item of the wrong type", person, `{"name": "Ann", "age": 31, "tags": ["a", 1]}`, false},
+		{"nested item missing required", person, `{"name": "Ann", "age": 31, "pets": [{"kind": "cat"}, {}]}`, false},
+		{"nested item additional property", person, `{"name": "Ann", "age": 31, "pets": [{"kind": "cat", "name": "Tom"}]}`, false},
+		{"too many items", person, `{"name": "Ann", "age": 31, "tags": ["a", "b", "c"]}`, false},
+
+		{"integer for integer", person, `{"name": "Ann", "age": 31}`, true},
+		{"fraction for integer", person, `{"name": "Ann", "age": 31.5}`, false},
+		{"integer for number", person, `{"name": "Ann", "age": 31, "height": 2}`, true},
+		{"fraction for number", person, `{"name": "Ann", "age": 31, "height": 1.75}`, true},
+		{"below the minimum", person, `{"name": "Ann", "age": -1}`, false},
+		{"too short", person, `{"name": "", "age": 31}`, false},
+
+		{"type list", `{"type": ["string", "null"]}`, `null`, true},
+		{"type list mismatch", `{"type": ["string", "null"]}`, `false`, false},
+		{"const", `{"const": 42}`, `42`, true},
+		{"const mismatch", `{"const": 42}`, `43`, false},
+		{"additional properties schema", `{"type": "object", "additionalProperties": {"type": "integer"}}`, `{"a": 1, "b": 2}`, true},
+		{"additional properties schema mismatch", `{"type": "object", "additionalProperties": {"type": "integer"}}`, `{"a": 1, "b": "2"}`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateFormat(json.RawMessage(test.format), test.answer)
+			if test.valid && err != nil {
+				t.Errorf("expected %s to validate, got %v", test.answer, err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("expected %s not to validate", test.answer)
+			}
+		})
+	}
+}
@@ -2,17 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
+	"html"
 	"io"
 	"log"
 	"math/big"
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 	"unicode"
@@ -26,16 +30,19 @@ const MAX_SEARCH_HITS = 10
 
 const MIN_CHAT_SECTION = 50
 
+// timeout of page fetches, long enough for cloudflare checks
+const FETCH_TIMEOUT = 100 * time.Second
+
 const MIN_PROMPT_WORDS = 8
 
 type LLMRequest struct {
-	Model   string `json:"model"`
-	Prompt  string `json:"prompt"`
-	Suffix  string `json:"suffix"`
-	Options struct {
-		Temperature float64 `json:"temperature"`
-	}
-	Stream bool `json:"stream"`
+	Model     string          `json:"model"`
+	Prompt    string          `json:"prompt"`
+	Suffix    string          `json:"suffix"`
+	Options   ModelOptions    `json:"options"`
+	Stream    bool            `json:"stream"`
+	KeepAlive interface{}     `json:"keep_alive,omitempty"`
+	Format    json.RawMessage `json:"format,omitempty"`
 }
 
 // LLMAnswer
@@ -44,6 +51,7 @@ type LLMAnswer struct {
 	CreatedAt          string   `json:"created_at"`
 	Message            Messages `json:"message"`
 	Done               bool     `json:"done"`
+	DoneReason         string   `json:"done_reason,omitempty"`
 	TotalDuration      int64    `json:"total_duration"`
 	LoadDuration       int64    `json:"load_duration"`
 	PromptEvalCount    int64    `json:"prompt_eval_count"`
@@ -69,13 +77,16 @@ type LLMGenerateAnswer struct {
 
 // Messages
 type Messages struct {
-	Id       int    `json:"id"`
-	Role     string `json:"role"`
-	Content  string `json:"content"`
-	Persona  string `json:"persona"`
-	IsMemory bool   `json:"is_memory"`
-	FirstId  int    `json:"first_id"`
-	LastId   int    `json:"last_id"`
+	Id        int        `json:"id"`
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	Persona   string     `json:"persona"`
+	IsMemory  bool       `json:"is_memory"`
+	FirstId   int        `json:"first_id"`
+	LastId    int        `json:"last_id"`
+	Images    []string   `json:"images,omitempty"`     // base64, for vision models
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"` // tools the assistant asked for
+	ToolName  string     `json:"tool_name,omitempty"`  // tool whose result a "tool" message is
 }
 
 type MessagesExtended struct {
@@ -104,11 +115,13 @@ type memoryRequestStruct struct {
 	User_id           int `json:"user_id"`
 	First_chat_log_id int `json:"first_chat_log_id"`
 	Last_chat_log_id  int `json:"last_chat_log_id"`
+	Conversation_id   int `json:"conversation_id"`
 }
 
 type embeddedMemoryStruct struct {
-	UID    int    `json:"uid"`
-	Prompt string `json:"prompt"`
+	UID            int    `json:"uid"`
+	Prompt         string `json:"prompt"`
+	ConversationId int    `json:"conversation_id,omitempty"`
 }
 
 type memoryResponseStruct struct {
@@ -124,9 +137,10 @@ type embeddedMemoryAnswer struct {
 }
 
 type EmbeddingRequestStruct struct {
-	Summary string `json:"summary"`
-	UID     int    `json:"uid"`
-	MemID   int64  `json:"memid"`
+	Summary        string `json:"summary"`
+	UID            int    `json:"uid"`
+	MemID          int64  `json:"memid"`
+	ConversationId int    `json:"conversation_id,omitempty"`
 }
 
 type PsModelDetail struct {
@@ -152,6 +166,45 @@ type PsModelsData struct {
 	Models []PsModel `json:"models"`
 }
 
+// LoadedModel is a model loaded on one of the backends, as listed by /async/ps
+type LoadedModel struct {
+	Name              string   `json:"name"`
+	Model             string   `json:"model"`
+	Host              string   `json:"host"`
+	Digest            string   `json:"digest"`
+	Size              int64    `json:"size"`
+	SizeVram          int64    `json:"size_vram"`
+	ExpiresAt         string   `json:"expires_at"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	Format            string   `json:"format"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+	Pinned            bool     `json:"pinned"`
+}
+
+// PsStatus is returned by /async/ps. Model is the active chat model, as
+// returned before the endpoint listed every model.
+type PsStatus struct {
+	Model     string        `json:"model"`
+	Models    []LoadedModel `json:"models"`
+	TotalVram int64         `json:"total_vram"`
+	TotalSize int64         `json:"total_size"`
+}
+
+type TagModel struct {
+	Name       string         `json:"name"`
+	Model      string         `json:"model"`
+	ModifiedAt string         `json:"modified_at"`
+	Size       int64          `json:"size"`
+	Digest     string         `json:"digest"`
+	Details    *PsModelDetail `json:"details"`
+}
+
+type TagsData struct {
+	Models []TagModel `json:"models"`
+}
+
 type Query struct {
 	Query string `json:"query"`
 }
@@ -171,12 +224,19 @@ type DetailRequest struct {
 }
 
 type Payload struct {
-	Model       string     `json:"model"`
-	Stream      bool       `json:"stream"`
-	Temperature float64    `json:"temperature"`
-	Messages    []Messages `json:"messages"`
-	KeepAlive   int        `json:"keep_alive"`
-	// NumCtx   int       `json:"num_ctx"` // Uncomment if needed
+	Model          string          `json:"model"`
+	Stream         bool            `json:"stream"`
+	Temperature    float64         `json:"temperature"`
+	Messages       []Messages      `json:"messages"`
+	KeepAlive      interface{}     `json:"keep_alive,omitempty"` // seconds or a duration like "10m", Ollama's default if unset
+	Options        *ModelOptions   `json:"options,omitempty"`
+	Format         json.RawMessage `json:"format,omitempty"`          // "json" or a JSON schema the answer must validate against
+	CallbackURL    string          `json:"callback_url,omitempty"`    // POSTed the final job status, not sent to Ollama
+	PersonaId      int             `json:"persona_id,omitempty"`      // server-side persona completing the request, not sent to Ollama
+	LogChat        bool            `json:"log_chat,omitempty"`        // store prompt and answer in chat_log, not sent to Ollama
+	UseTools       bool            `json:"use_tools,omitempty"`       // let the model search the web and fetch pages
+	ConversationId int             `json:"conversation_id,omitempty"` // thread for memories and log_chat, not sent to Ollama
+	Message        *Messages       `json:"message,omitempty"`         // instead of messages: the history is read from the conversation
 }
 
 // /////////////////////
@@ -253,6 +313,9 @@ func chatHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to identify user!", http.StatusInternalServerError)
 		return
 	}
+	if !enforceLimits(w, uid, true) {
+		return
+	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -262,34 +325,118 @@ func chatHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	var payload Payload
 	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
 
-	lastMessage := payload.Messages[len(payload.Messages)-1]
-	if lastMessage.Role == "user" && countWords(lastMessage.Content) > MIN_PROMPT_WORDS {
-		memory := retrieveMemoryByEmbedding(uid, lastMessage.Content)
-		if memory != "" {
-			payload.Messages[len(payload.Messages)-1].Content = "[System Message: the following memory flashes through your mind. Please treat any memory flashes as purely optional background context and not intended to imply they are relevant. There is no need to mention them. *** START OF MEMORY ***\n" + memory + "\n*** END OF MEMORY ***]\n" + lastMessage.Content
+	uniqueID, status, err := queueChat(uid, payload)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write([]byte(`{"uniqueID":"` + uniqueID + `"}`))
+	if err != nil {
+		return
+	}
+}
+
+// queueChat completes a chat request (persona, assembled context, memory
+// flash), checks it and queues it. On failure it returns the HTTP status
+// to answer with.
+func queueChat(uid int, payload Payload) (string, int, error) {
+	if payload.CallbackURL != "" && !validCallbackURL(payload.CallbackURL) {
+		return "", http.StatusBadRequest, errors.New("Invalid callback_url")
+	}
+	if payload.CallbackURL != "" && os.Getenv("WEBHOOK_SECRET") == "" {
+		// webhooks signed with an empty key could come from anyone
+		return "", http.StatusBadRequest, errors.New("callback_url needs WEBHOOK_SECRET to be set on the server")
+	}
+	if payload.Message != nil && len(payload.Messages) > 0 {
+		return "", http.StatusBadRequest, errors.New("Send either messages or message")
+	}
+	db, _ := getDb()
+	if !ownsConversation(db, uid, payload.ConversationId) {
+		db.Close()
+		return "", http.StatusNotFound, errors.New("Conversation not found")
+	}
+	if payload.PersonaId != 0 {
+		persona, err := loadPersona(db, uid, payload.PersonaId)
+		if err != nil {
+			db.Close()
+			return "", http.StatusBadRequest, errors.New("Unknown persona")
+		}
+		applyPersona(&payload, persona)
+	}
+	if payload.Message != nil && payload.Message.Role == "" {
+		payload.Message.Role = "user"
+	}
+
+	// the memory flash must fit into the context window of an assembled
+	// prompt along with the turns
+	flash := ""
+	prompt := payload.Message
+	if prompt == nil && len(payload.Messages) > 0 {
+		prompt = &payload.Messages[len(payload.Messages)-1]
+	}
+	if prompt != nil && prompt.Role == "user" && countWords(prompt.Content) > MIN_PROMPT_WORDS {
+		flash = memoryFlash(uid, payload.ConversationId, prompt.Content)
+	}
+
+	if payload.Message != nil {
+		err := assembleContext(db, uid, &payload, estimateTokens(flash))
+		if errors.Is(err, errSummaryFailed) {
+			db.Close()
+			return "", http.StatusServiceUnavailable, err
+		}
+		if err != nil {
+			db.Close()
+			return "", http.StatusBadRequest, err
 		}
 	}
+	db.Close()
+	if len(payload.Messages) == 0 {
+		return "", http.StatusBadRequest, errors.New("no messages given")
+	}
+
+	err := normalizeMessageImages(payload.Messages)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	// logged with normalized images and without the memory flash
+	lastMessage := payload.Messages[len(payload.Messages)-1]
+	payload.Messages[len(payload.Messages)-1].Content = flash + lastMessage.Content
+	err = validatePayload(payload)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+
 	uniqueID := uuid.New().String()
 
 	fmt.Println("uniqueId: " + uniqueID)
 
-	db, _ := getDb()
-	defer db.Close()
-
-	_, err = db.Exec("INSERT INTO async (uuid, prompt, answer) VALUES (?, ?, 'still processing')", uniqueID, string(body)[:50])
+	var userTurn *Messages
+	if lastMessage.Role == "user" {
+		userTurn = &lastMessage
+	}
+	err = submitChatJob(uniqueID, uid, payload, userTurn)
 	if err != nil {
 		fmt.Printf("Failed to insert data into MariaDB database: %v", err)
+		return "", http.StatusInternalServerError, errors.New("Failed to queue request")
 	}
-	go func() {
-		asyncChatRequest(uniqueID, payload)
-	}()
+	return uniqueID, http.StatusOK, nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	_, err = w.Write([]byte(`{"uniqueID":"` + uniqueID + `"}`))
-	if err != nil {
-		return
+// memoryFlash returns what is prepended to a prompt when a memory of the
+// conversation comes to mind, if any
+func memoryFlash(uid int, conversationId int, prompt string) string {
+	memory := retrieveMemoryByEmbedding(uid, conversationId, prompt)
+	if memory == "" {
+		return ""
 	}
+	return "[System Message: the following memory flashes through your mind. Please treat any memory flashes as purely optional background context and not intended to imply they are relevant. There is no need to mention them. *** START OF MEMORY ***\n" + memory + "\n*** END OF MEMORY ***]\n"
 }
 
 func countWords(s string) int {
@@ -309,241 +456,258 @@ func countWords(s string) int {
 	return count
 }
 
+// estimateTokens roughly estimates the tokens of a text, at 4 characters
+// per token
+func estimateTokens(s string) int {
+	return (len(s) + 3) / 4
+}
+
 func responseHandler(w http.ResponseWriter, r *http.Request) {
 
 	uid := r.URL.Query().Get("uid") // Assuming /companion/response?uid=<uid> as Go's http package doesn't handle URL parameters directly
 
-	// Fetch the answer from the queue table
-	var sqlAnswer string
+	// Fetch the job from the queue table
 	db, _ := getDb()
 	defer db.Close()
-	err := db.QueryRow("SELECT answer FROM async WHERE uuid = ?", uid).Scan(&sqlAnswer)
+	status, err := loadJobStatus(db, uid)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			notFoundMsg := LLMAnswer{Model: "not found"}
+			notFoundMsg := JobStatus{LLMAnswer: LLMAnswer{Model: "not found"}, UniqueID: uid, State: "not found"}
 			jsonRes, _ := json.Marshal(notFoundMsg)
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusOK)
 			w.Write(jsonRes)
 		} else {
+			fmt.Printf("Failed to load job %s: %v", uid, err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		}
 		return
 	}
 
-	// If the answer is still processing
-	if sqlAnswer == "" {
-		stillProcessingMsg := LLMAnswer{Model: "still processing"}
-		jsonRes, _ := json.Marshal(stillProcessingMsg)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write(jsonRes)
-		return
-	}
-
-	var answer map[string]interface{}
-	err = json.Unmarshal([]byte(sqlAnswer), &answer)
-	if err != nil {
-		stillProcessingMsg := LLMAnswer{Model: "still processing"}
-		jsonRes, _ := json.Marshal(stillProcessingMsg)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write(jsonRes)
-		return
-	}
-
-	// Delete the entry from the queue
-	_, err = db.Exec("DELETE FROM async WHERE uuid = ?", uid)
-	db.Close()
-	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+	// Delete finished jobs from the queue once they have been fetched
+	if isFinalState(status.State) {
+		_, err = db.Exec("DELETE FROM async WHERE uuid = ?", uid)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		clearJobSteps(db, uid)
 	}
 
-	// Return the answer
-	jsonRes, _ := json.Marshal(answer)
+	// Return the job status
+	jsonRes, _ := json.Marshal(status)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write(jsonRes)
 }
 
-func unloadHandler(w http.ResponseWriter, r *http.Request) {
-
-	requestBody, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
-		return
-	}
-	defer r.Body.Close()
-	// Create custom HTTP client with a 2 seconds timeout
-	client := &http.Client{
-		Timeout: 1,
-	}
-	var prompt LLMRequest
-	err = json.Unmarshal(requestBody, &prompt)
-	if err != nil {
-		http.Error(w, "Failed to unmarshal request body", http.StatusInternalServerError)
-		return
+// getModelTags merges the models available on the healthy backends
+func getModelTags() (TagsData, error) {
+	var tags TagsData
+	seen := make(map[string]bool)
+	var lastErr error
+	for _, backend := range healthyBackends() {
+		responseBody, err := ollamaRequestOn(backend, "GET", "/api/tags", nil, 10*time.Minute)
+		if err != nil {
+			fmt.Printf("Failed to make tags request to %s: %v", backend.Host, err)
+			lastErr = err
+			continue
+		}
+		var backendTags TagsData
+		err = json.Unmarshal(responseBody, &backendTags)
+		if err != nil {
+			fmt.Printf("Failed to unmarshal tags of %s: %v", backend.Host, err)
+			lastErr = err
+			continue
+		}
+		for _, model := range backendTags.Models {
+			if !seen[model.Name] {
+				seen[model.Name] = true
+				tags.Models = append(tags.Models, model)
+			}
+		}
 	}
-	fmt.Printf("Prompt: %v\n", prompt)
-	fmt.Printf("Prompt: %v\n", requestBody)
-	// Create a new request
-	req, err := http.NewRequest("POST", "http://ollama.local:11111/api/chat", bytes.NewBuffer(requestBody))
-	if err != nil {
-		fmt.Printf("Failed to create new request: %v", err)
-		return
+	if tags.Models == nil && lastErr != nil {
+		return tags, lastErr
 	}
-	req.Header.Set("Content-Type", "application/json")
-
-	// Perform the request
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Printf("Failed to make Cleanup request to external service: %v", err)
-		return
+	if tags.Models == nil {
+		tags.Models = []TagModel{}
 	}
-	defer resp.Body.Close()
-	w.WriteHeader(http.StatusOK)
+	return tags, nil
 }
 
 func tagsHandler(w http.ResponseWriter, r *http.Request) {
-	// Create custom HTTP client with a 10-minute timeout
-	client := &http.Client{
-		Timeout: 10 * time.Minute,
-	}
-
-	// Create a new request
-	req, err := http.NewRequest("GET", "http://ollama.local:11111/api/tags", nil)
+	tags, err := getModelTags()
 	if err != nil {
-		fmt.Printf("Failed to create new request: %v", err)
+		fmt.Printf("Failed to make tags request to external service: %v", err)
+		http.Error(w, "Failed to list models", http.StatusBadGateway)
 		return
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	// Perform the request
-	resp, err := client.Do(req)
+	responseBody, err := json.Marshal(tags)
 	if err != nil {
-		fmt.Printf("Failed to make PS request to external service: %v", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	responseBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Printf("Failed to read response from external service: %v", err)
+		fmt.Printf("Failed to marshal tags: %v", err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(responseBody)
 }
 
+// getCurrentModelList merges the models loaded on the healthy backends
 func getCurrentModelList() PsModelsData {
-	// Create custom HTTP client with a 10-minute timeout
-	client := &http.Client{
-		Timeout: 10 * time.Minute,
+	var currentModelList PsModelsData
+	for _, backend := range healthyBackends() {
+		backendModels, err := backend.fetchPs(10 * time.Minute)
+		if err != nil {
+			fmt.Printf("Failed to make PS request to %s: %v", backend.Host, err)
+			continue
+		}
+		currentModelList.Models = append(currentModelList.Models, backendModels.Models...)
 	}
+	return currentModelList
+}
 
-	// Create a new request
-	req, err := http.NewRequest("GET", "http://ollama.local:11111/api/ps", nil)
-	if err != nil {
-		fmt.Printf("Failed to create new request: %v", err)
-		return PsModelsData{}
+// activeChatModel is the first loaded model which isn't the summarizer, or
+// the summarizer if nothing else is loaded
+func activeChatModel(models []PsModel) string {
+	summarizer := os.Getenv("SUMMARIZER")
+	if len(models) == 0 {
+		return "none"
 	}
-	req.Header.Set("Content-Type", "application/json")
-
-	// Perform the request
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Printf("Failed to make PS request to external service: %v", err)
-		return PsModelsData{}
+	for _, model := range models {
+		if model.Name != summarizer {
+			return model.Name
+		}
 	}
-	defer resp.Body.Close()
+	return summarizer
+}
 
-	responseBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Printf("Failed to read response from external service: %v", err)
-		return PsModelsData{}
+func psHandler(w http.ResponseWriter, r *http.Request) {
+	status := PsStatus{Models: []LoadedModel{}}
+	var allModels []PsModel
+
+	for _, backend := range healthyBackends() {
+		backendModels, err := backend.fetchPs(10 * time.Minute)
+		if err != nil {
+			fmt.Printf("Failed to make PS request to %s: %v", backend.Host, err)
+			continue
+		}
+		for _, model := range backendModels.Models {
+			loaded := LoadedModel{
+				Name:      model.Name,
+				Model:     model.Model,
+				Host:      backend.Host,
+				Digest:    model.Digest,
+				Size:      model.Size.Int64(),
+				SizeVram:  model.SizeVram.Int64(),
+				ExpiresAt: model.ExpiresAt,
+				Pinned:    isPinned(model.Name),
+			}
+			if model.Details != nil {
+				loaded.Family = model.Details.Family
+				loaded.Families = model.Details.Families
+				loaded.Format = model.Details.Format
+				loaded.ParameterSize = model.Details.ParameterSize
+				loaded.QuantizationLevel = model.Details.QuantizationLevel
+			}
+			status.TotalVram += loaded.SizeVram
+			status.TotalSize += loaded.Size
+			status.Models = append(status.Models, loaded)
+		}
+		allModels = append(allModels, backendModels.Models...)
 	}
+	status.Model = activeChatModel(allModels)
 
-	fmt.Printf(string(responseBody))
-	var currentModelList PsModelsData
-	err = json.Unmarshal(responseBody, &currentModelList)
+	jsonRes, err := json.Marshal(status)
 	if err != nil {
-		fmt.Printf("Failed to unmarshal model list response: %v", err)
-		return PsModelsData{}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
-	return currentModelList
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonRes)
 }
 
-func psHandler(w http.ResponseWriter, r *http.Request) {
-
-	currentModelList := getCurrentModelList()
-
-	summarizer := os.Getenv("SUMMARIZER")
-	foundAlternative := false
-	var alternativeName string
-
-	for _, model := range currentModelList.Models {
-		if model.Name != summarizer {
-			alternativeName = model.Name
-			foundAlternative = true
-			break
+// Perform asynchronous request to Ollama. The answer is always requested as a
+// stream, whose tokens are relayed to the job's stream, and returned once
+// assembled. Should a backend fail, the request starts over on another one.
+// With a format, answers which don't validate are sent back to the model
+// along with what is wrong, so the answer is only returned once valid. The
+// counts of the answer cover all the attempts.
+func asyncChatRequest(ctx context.Context, uuid string, stream *chatStream, payload Payload) (LLMAnswer, error) {
+	payload.Stream = true
+	if isPinned(payload.Model) {
+		payload.KeepAlive = KEEP_ALIVE_FOREVER
+	}
+
+	var spent LLMAnswer
+	for attempt := 1; ; attempt++ {
+		answer, err := chatWithTools(ctx, uuid, stream, &payload)
+		answer.addUsage(spent)
+		spent = answer
+		if err != nil || !hasFormat(payload.Format) {
+			return answer, err
+		}
+		formatErr := validateFormat(payload.Format, answer.Message.Content)
+		if formatErr == nil {
+			return answer, nil
+		}
+		if attempt >= MAX_FORMAT_ATTEMPTS {
+			return answer, fmt.Errorf("no valid answer after %d attempts: %v", attempt, formatErr)
 		}
+		fmt.Printf("Answer of job %s doesn't match its format, asking again: %v\n", uuid, formatErr)
+		payload.Messages = append(payload.Messages,
+			Messages{Role: "assistant", Content: answer.Message.Content},
+			Messages{Role: "user", Content: correctionPrompt(formatErr)})
+		stream.reset()
 	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
-
-	if len(currentModelList.Models) == 0 {
-		// No models found
-		w.Write([]byte(`{"model":"none"}`))
-	} else if foundAlternative {
-		// Found an alternative model name
-		w.Write([]byte(`{"model":"` + alternativeName + `"}`))
-	} else {
-		// All model names match the summarizer
-		w.Write([]byte(`{"model":"` + summarizer + `"}`))
+func chatWithFailover(ctx context.Context, stream *chatStream, payload Payload) (LLMAnswer, error) {
+	reqBody, err := json.Marshal(chatRequest(payload))
+	if err != nil {
+		return LLMAnswer{}, fmt.Errorf("failed to marshal request body: %v", err)
 	}
+
+	var answer LLMAnswer
+	attempt := 0
+	err = withFailover(ctx, payload.Model, func(backend *ollamaBackend) error {
+		attempt++
+		if attempt > 1 {
+			// the tokens of the failed backend are worthless
+			stream.reset()
+		}
+		answer, err = chatOnBackend(ctx, backend, stream, reqBody)
+		return err
+	})
+	return answer, err
 }
 
-// Perform asynchronous request and store result in the database
-func asyncChatRequest(uuid string, payload Payload) {
+func chatOnBackend(ctx context.Context, backend *ollamaBackend, stream *chatStream, reqBody []byte) (LLMAnswer, error) {
 	// Create custom HTTP client with a 10-minute timeout
 	client := &http.Client{
 		Timeout: 10 * time.Minute,
 	}
 
-	reqBody, err := json.Marshal(payload)
-	if err != nil {
-		fmt.Printf("Failed to marshal request body: %v", err)
-		return
-	}
 	// Create a new request
-	req, err := http.NewRequest("POST", "http://ollama.local:11111/api/chat", bytes.NewBuffer(reqBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", backend.Host+"/api/chat", bytes.NewBuffer(reqBody))
 	if err != nil {
-		fmt.Printf("Failed to create new request: %v", err)
-		return
+		return LLMAnswer{}, fmt.Errorf("failed to create new request: %v", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	// Perform the request
 	resp, err := client.Do(req)
 	if err != nil {
-		fmt.Printf("Failed to make request to external service: %v", err)
-		return
+		return LLMAnswer{}, fmt.Errorf("failed to make request to %s: %w", backend.Host, err)
 	}
 	defer resp.Body.Close()
 
-	responseBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Printf("Failed to read response from external service: %v", err)
-		return
+	if resp.StatusCode != http.StatusOK {
+		errorBody, _ := io.ReadAll(resp.Body)
+		return LLMAnswer{}, &backendStatusError{StatusCode: resp.StatusCode, Body: string(errorBody)}
 	}
 
-	db, _ := getDb()
-	defer db.Close()
-	_, err = db.Exec("UPDATE async SET answer = ? WHERE uuid=?", string(responseBody), uuid)
-	if err != nil {
-		fmt.Printf("Failed to insert data into SQLite database: %v", err)
-	}
+	return readChatStream(stream, resp.Body)
 }
 
 /////////////////////////////////////////////////////////////
@@ -568,6 +732,11 @@ func storeChatLogHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
 		return
 	}
+	messages.Images, err = normalizeImages(messages.Images)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	now := time.Now()
 
@@ -577,10 +746,15 @@ func storeChatLogHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	db, _ := getDb()
 	defer db.Close()
-	_, err = db.Exec("INSERT INTO chat_log (user_id, persona, role, content, datetime) VALUES (?,?,?,?,?)", userId, messages.Persona, messages.Role, messages.Content, now)
+	conversationId, ok := requestConversation(w, r, db, userId)
+	if !ok {
+		return
+	}
+	_, err = db.Exec("INSERT INTO chat_log (user_id, persona, role, content, images, conversation_id, datetime) VALUES (?,?,?,?,?,?,?)", userId, messages.Persona, messages.Role, messages.Content, marshalImages(messages.Images), conversationParam(conversationId), now)
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 	}
+	touchConversation(db, conversationId)
 	return
 }
 
@@ -596,8 +770,12 @@ func getChatLogHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
+	conversationId, ok := requestConversation(w, r, db, userId)
+	if !ok {
+		return
+	}
 
-	rows, err := db.Query("SELECT id, persona, role, content FROM chat_log WHERE user_id = ? ORDER BY id", userId)
+	rows, err := db.Query("SELECT id, persona, role, content, images FROM chat_log WHERE user_id = ? AND conversation_id <=> ? ORDER BY id", userId, conversationParam(conversationId))
 	if err != nil {
 		http.Error(w, "Internal Server Error 2", http.StatusInternalServerError)
 		return
@@ -606,11 +784,13 @@ func getChatLogHandler(w http.ResponseWriter, r *http.Request) {
 
 	for rows.Next() {
 		var msg Messages
-		err = rows.Scan(&msg.Id, &msg.Persona, &msg.Role, &msg.Content)
+		var images sql.NullString
+		err = rows.Scan(&msg.Id, &msg.Persona, &msg.Role, &msg.Content, &images)
 		if err != nil {
 			http.Error(w, "Internal Server Error 3", http.StatusInternalServerError)
 			return
 		}
+		msg.Images = unmarshalImages(images)
 		messages = append(messages, msg)
 	}
 
@@ -629,7 +809,7 @@ func getChatLogHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonRes)
 }
 
-func generateChatSegment(uid int, username string, initialId int) (int, int, string, bool) {
+func generateChatSegment(uid int, conversationId int, username string, initialId int) (int, int, string, bool) {
 	db, err := getDb()
 	defer db.Close()
 	if err != nil {
@@ -637,8 +817,8 @@ func generateChatSegment(uid int, username string, initialId int) (int, int, str
 		return -1, -1, "", false
 	}
 
-	query := "SELECT id, persona, role, content FROM chat_log WHERE is_summarized = false AND user_id = ? AND id > ? ORDER BY id"
-	rows, err := db.Query(query, uid, initialId)
+	query := "SELECT id, persona, role, content FROM chat_log WHERE is_summarized = false AND user_id = ? AND conversation_id <=> ? AND id > ? ORDER BY id"
+	rows, err := db.Query(query, uid, conversationParam(conversationId), initialId)
 	if err != nil {
 		fmt.Printf("Failed to execute query: %v", err)
 		return -1, -1, "", false
@@ -689,7 +869,7 @@ func generateChatSegment(uid int, username string, initialId int) (int, int, str
 	return firstID, lastID, segment, true
 }
 
-func generateSummary(uid int) {
+func generateSummary(uid int, conversationId int) {
 	doSummary := true
 	initialId := -1
 	db, err := getDb()
@@ -708,7 +888,7 @@ func generateSummary(uid int) {
 	cnt := 1
 
 	for doSummary {
-		firstId, lastId, chatSection, generateSuccess := generateChatSegment(uid, username, initialId)
+		firstId, lastId, chatSection, generateSuccess := generateChatSegment(uid, conversationId, username, initialId)
 		if !generateSuccess {
 			break
 		}
@@ -727,13 +907,14 @@ func generateSummary(uid int) {
 			Model:  summarizer,
 			Prompt: chatSection + "\nWrite a short summary of the discussion written above.",
 		}
-		llmRequest.Options.Temperature = 1.0
+		llmRequest.Options.Temperature = floatOption(1.0)
 
 		options := memoryRequestStruct{
 			Request_id:        cnt,
 			User_id:           uid,
 			First_chat_log_id: firstId,
 			Last_chat_log_id:  lastId,
+			Conversation_id:   conversationId,
 		}
 		cnt++
 		body, err := json.Marshal(llmRequest)
@@ -743,12 +924,14 @@ func generateSummary(uid int) {
 			break
 		}
 
-		go asyncSummaryRequest(options, body)
+		queue.enqueueBackground(fmt.Sprintf("summary %d/%d: %d-%d", uid, conversationId, firstId, lastId), func() {
+			asyncSummaryRequest(options, body)
+		})
 	}
 	return
 }
 
-func retrieveMemoryByEmbedding(uid int, content string) string {
+func retrieveMemoryByEmbedding(uid int, conversationId int, content string) string {
 	fmt.Println(">>>>> Retrieving Memory By Embeddings ... ")
 	// Create custom HTTP client with a 10-minute timeout
 	client := &http.Client{
@@ -756,8 +939,9 @@ func retrieveMemoryByEmbedding(uid int, content string) string {
 	}
 
 	bodyReq := embeddedMemoryStruct{
-		UID:    uid,
-		Prompt: content,
+		UID:            uid,
+		Prompt:         content,
+		ConversationId: conversationId,
 	}
 
 	body, err := json.Marshal(bodyReq)
@@ -793,10 +977,12 @@ func retrieveMemoryByEmbedding(uid int, content string) string {
 	if err != nil {
 		fmt.Println("Failed to unmarshal response 1")
 	}
-	return retrieveMemoryById(memory.ID)
+	return retrieveMemoryById(uid, conversationId, memory.ID)
 }
 
-func retrieveMemoryById(memoryId int) string {
+// retrieveMemoryById returns a memory of the conversation, or nothing if
+// the memory belongs to another one
+func retrieveMemoryById(uid int, conversationId int, memoryId int) string {
 	db, err := getDb()
 	defer db.Close()
 	if err != nil {
@@ -805,7 +991,7 @@ func retrieveMemoryById(memoryId int) string {
 	}
 
 	var content string
-	err = db.QueryRow("SELECT content FROM memories WHERE id = ? LIMIT 1", memoryId).Scan(&content)
+	err = db.QueryRow("SELECT content FROM memories WHERE id = ? AND user_id = ? AND conversation_id <=> ? LIMIT 1", memoryId, uid, conversationParam(conversationId)).Scan(&content)
 	if err != nil {
 		content = ""
 	}
@@ -819,16 +1005,17 @@ func retrieveMemoryById(memoryId int) string {
 	return string(jsnAnswer)
 }
 
-func generateEmbeddings(uid int, memoryId int64, summary string) {
+func generateEmbeddings(uid int, conversationId int, memoryId int64, summary string) {
 	fmt.Println(">>>>> Generating Embeddings for Memory : ", memoryId)
 	// Create custom HTTP client with a 10-minute timeout
 	client := &http.Client{
 		Timeout: 10 * time.Minute,
 	}
 	embeddingReq := EmbeddingRequestStruct{
-		Summary: summary,
-		UID:     uid,
-		MemID:   memoryId,
+		Summary:        summary,
+		UID:            uid,
+		MemID:          memoryId,
+		ConversationId: conversationId,
 	}
 
 	body, err := json.Marshal(embeddingReq)
@@ -871,9 +1058,18 @@ func generateMemoriesHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	uid, _ := getUserId(w, r)
+	uid, err := getUserId(w, r)
+	if err != nil {
+		return
+	}
+	db, _ := getDb()
+	conversationId, ok := requestConversation(w, r, db, uid)
+	db.Close()
+	if !ok {
+		return
+	}
 
-	generateSummary(uid)
+	generateSummary(uid, conversationId)
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -890,10 +1086,8 @@ func asyncSummaryRequest(requestDetails memoryRequestStruct, requestBody []byte)
 	llmRequest := LLMRequest{
 		Model:  os.Getenv("SUMMARIZER"),
 		Prompt: summary + "\ngive me 10 semi-colon separated keywords for the previous text",
-		Options: struct {
-			Temperature float64 `json:"temperature"`
-		}{
-			Temperature: 1.0,
+		Options: ModelOptions{
+			Temperature: floatOption(1.0),
 		},
 		Stream: false,
 	}
@@ -915,64 +1109,69 @@ func asyncSummaryRequest(requestDetails memoryRequestStruct, requestBody []byte)
 	if os.Getenv("DEBUG") != "1" {
 		db, _ := getDb()
 		fmt.Println("Commiting memory to DB.")
-		result, err := db.Exec("INSERT INTO memories (user_id, first_chat_log_id, last_chat_log_id, content, keywords)  VALUES (?, ?, ?, ?, ?)", requestDetails.User_id, requestDetails.First_chat_log_id, requestDetails.Last_chat_log_id, summary, keywords)
+		conversation := conversationParam(requestDetails.Conversation_id)
+		result, err := db.Exec("INSERT INTO memories (user_id, first_chat_log_id, last_chat_log_id, content, keywords, conversation_id)  VALUES (?, ?, ?, ?, ?, ?)", requestDetails.User_id, requestDetails.First_chat_log_id, requestDetails.Last_chat_log_id, summary, keywords, conversation)
 		if err != nil {
 			fmt.Printf("Failed to insert data into SQLite database: %v", err)
 		}
 
 		fmt.Printf("Updating chat_log entries %i to %i.\n", requestDetails.First_chat_log_id, requestDetails.Last_chat_log_id)
-		_, err = db.Exec("UPDATE chat_log SET is_summarized=1 WHERE id>=? AND id <=?", requestDetails.First_chat_log_id, requestDetails.Last_chat_log_id)
+		// the range may hold rows of other conversations
+		_, err = db.Exec("UPDATE chat_log SET is_summarized=1 WHERE id>=? AND id <=? AND user_id = ? AND conversation_id <=> ?", requestDetails.First_chat_log_id, requestDetails.Last_chat_log_id, requestDetails.User_id, conversation)
 		if err != nil {
 			fmt.Printf("Failed to insert data into SQLite database: %v", err)
 		}
 		_ = db.Close()
 
 		memId, _ := result.LastInsertId()
-		generateEmbeddings(requestDetails.User_id, memId, keywords)
+		generateEmbeddings(requestDetails.User_id, requestDetails.Conversation_id, memId, keywords)
 	}
 
 	fmt.Println("Done with query", requestDetails.Request_id)
 }
 
 func callGenerateOnSummarizer(requestBody []byte) (string, error) {
-	// Create custom HTTP client with a 10-minute timeout
-	client := &http.Client{
-		Timeout: 10 * time.Minute,
-	}
-
-	// Create a new request
-	req, err := http.NewRequest("POST", "http://ollama.local:11111/api/generate", bytes.NewBuffer(requestBody))
+	var request LLMRequest
+	err := json.Unmarshal(requestBody, &request)
 	if err != nil {
-		msg := fmt.Sprintf("Failed to create new request: %v", err)
+		msg := fmt.Sprintf("Could not unmarshal request: %v", err)
 		return msg, err
 	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	// Perform the request
-	resp, err := client.Do(req)
-	if err != nil {
-		msg := fmt.Sprintf("Failed to make request to external service: %v", err)
-		return msg, err
+	if isPinned(request.Model) {
+		request.KeepAlive = KEEP_ALIVE_FOREVER
+		requestBody, _ = json.Marshal(request)
 	}
 
-	defer resp.Body.Close()
+	for attempt := 1; ; attempt++ {
+		// Perform the request, with a 10-minute timeout
+		responseBody, err := ollamaRequest(request.Model, "POST", "/api/generate", requestBody, 10*time.Minute)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to make request to external service: %v", err)
+			return msg, err
+		}
 
-	responseBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		msg := fmt.Sprintf("Failed to read response from external service: %v", err)
-		return msg, err
-	}
+		var generateResponse LLMGenerateAnswer
 
-	var generateResponse LLMGenerateAnswer
+		err = json.Unmarshal(responseBody, &generateResponse)
+		if err != nil {
+			msg := fmt.Sprintf("Could not unmarshal response: %v", err)
+			return msg, err
+		}
+		if !hasFormat(request.Format) {
+			return generateResponse.Response, nil
+		}
 
-	err = json.Unmarshal(responseBody, &generateResponse)
-	if err != nil {
-		msg := fmt.Sprintf("Could not unmarshal response: %v", err)
-		return msg, err
+		formatErr := validateFormat(request.Format, generateResponse.Response)
+		if formatErr == nil {
+			return generateResponse.Response, nil
+		}
+		if attempt >= MAX_FORMAT_ATTEMPTS {
+			msg := fmt.Sprintf("No valid answer after %d attempts: %v", attempt, formatErr)
+			return msg, formatErr
+		}
+		request.Prompt += "\n\n" + generateResponse.Response + "\n\n" + correctionPrompt(formatErr)
+		requestBody, _ = json.Marshal(request)
 	}
-
-	return generateResponse.Response, nil
 }
 
 func retrieveDiscussionHandler(w http.ResponseWriter, r *http.Request) {
@@ -983,8 +1182,13 @@ func retrieveDiscussionHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	db, _ := getDb()
 	defer db.Close()
+	conversationId, ok := requestConversation(w, r, db, uid)
+	if !ok {
+		return
+	}
+	conversation := conversationParam(conversationId)
 
-	summaryRows, err := db.Query("SELECT m.id, 'system' AS persona, 'user' AS role, m.content, cl.datetime, m.first_chat_log_id, m.last_chat_log_id FROM memories AS m, chat_log AS cl WHERE m.user_id=? AND cl.id = m.last_chat_log_id ORDER BY first_chat_log_id DESC LIMIT 10", uid)
+	summaryRows, err := db.Query("SELECT m.id, 'system' AS persona, 'user' AS role, m.content, cl.datetime, m.first_chat_log_id, m.last_chat_log_id FROM memories AS m, chat_log AS cl WHERE m.user_id=? AND m.conversation_id <=> ? AND cl.id = m.last_chat_log_id ORDER BY first_chat_log_id DESC LIMIT 10", uid, conversation)
 	if err != nil {
 		fmt.Printf("Failed to get latest 10 memories from memories: %v", err)
 	}
@@ -1006,7 +1210,7 @@ func retrieveDiscussionHandler(w http.ResponseWriter, r *http.Request) {
 		msgExt.IsMemory = true
 		formattedContent := fmt.Sprintf("(%s) %s", msgExt.Datetime.Format(time.RFC3339), msgExt.Content)
 
-		msg := Messages{msgExt.Id, "assistant", formattedContent, "Memory", true, msgExt.FirstId, msgExt.LastId}
+		msg := Messages{Id: msgExt.Id, Role: "assistant", Content: formattedContent, Persona: "Memory", IsMemory: true, FirstId: msgExt.FirstId, LastId: msgExt.LastId}
 		messages = append(messages, msg)
 	}
 
@@ -1014,7 +1218,7 @@ func retrieveDiscussionHandler(w http.ResponseWriter, r *http.Request) {
 		messages[i], messages[j] = messages[j], messages[i]
 	}
 
-	latestRows, err := db.Query("SELECT id, persona, role, content FROM chat_log WHERE user_id=? AND is_summarized = false AND datetime > ? AND role != 'system'", uid, latestDatetime)
+	latestRows, err := db.Query("SELECT id, persona, role, content, images FROM chat_log WHERE user_id=? AND conversation_id <=> ? AND is_summarized = false AND datetime > ? AND role != 'system'", uid, conversation, latestDatetime)
 	if err != nil {
 		fmt.Printf("Failed to get latest logs from chat_log: %v", err)
 	}
@@ -1022,11 +1226,13 @@ func retrieveDiscussionHandler(w http.ResponseWriter, r *http.Request) {
 
 	for latestRows.Next() {
 		var msg Messages
-		err = latestRows.Scan(&msg.Id, &msg.Persona, &msg.Role, &msg.Content)
+		var images sql.NullString
+		err = latestRows.Scan(&msg.Id, &msg.Persona, &msg.Role, &msg.Content, &images)
 		if err != nil {
 			http.Error(w, "Internal Server Error 2", http.StatusInternalServerError)
 			return
 		}
+		msg.Images = unmarshalImages(images)
 		msg.IsMemory = false
 		msg.FirstId = -1
 		msg.LastId = -1
@@ -1056,6 +1262,10 @@ func getMemoryDetailsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	db, _ := getDb()
 	defer db.Close()
+	conversationId, ok := requestConversation(w, r, db, uid)
+	if !ok {
+		return
+	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -1077,7 +1287,7 @@ func getMemoryDetailsHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Println(detailRequest.FirstId)
 	fmt.Println(detailRequest.LastId)
 
-	detailsRows, err := db.Query("SELECT id, persona, role, content FROM chat_log WHERE user_id=? AND id >= ? AND id <= ? ORDER BY datetime", uid, detailRequest.FirstId, detailRequest.LastId)
+	detailsRows, err := db.Query("SELECT id, persona, role, content, images FROM chat_log WHERE user_id=? AND conversation_id <=> ? AND id >= ? AND id <= ? ORDER BY datetime", uid, conversationParam(conversationId), detailRequest.FirstId, detailRequest.LastId)
 	if err != nil {
 		fmt.Printf("Failed to get latest 10 memories from memories: %v", err)
 	}
@@ -1087,11 +1297,13 @@ func getMemoryDetailsHandler(w http.ResponseWriter, r *http.Request) {
 
 	for detailsRows.Next() {
 		var msg Messages
-		err = detailsRows.Scan(&msg.Id, &msg.Persona, &msg.Role, &msg.Content)
+		var images sql.NullString
+		err = detailsRows.Scan(&msg.Id, &msg.Persona, &msg.Role, &msg.Content, &images)
 		if err != nil {
 			http.Error(w, "Internal Server Error 1", http.StatusInternalServerError)
 			return
 		}
+		msg.Images = unmarshalImages(images)
 		messages = append(messages, msg)
 	}
 	jsonRes, err := json.Marshal(messages)
@@ -1176,13 +1388,24 @@ func loginByCsrfHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func getUserId(w http.ResponseWriter, r *http.Request) (int, error) {
+// lookupUserId returns the user of the request's token, sql.ErrNoRows if
+// there is none
+func lookupUserId(r *http.Request) (int, error) {
 	csrfToken := r.Header.Get("X-CSRF-TOKEN")
+	if csrfToken == "" {
+		// OpenAI clients send the token as API key
+		csrfToken = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
 
 	db, _ := getDb()
 	defer db.Close()
 	var userid int
 	err := db.QueryRow("select id FROM users WHERE csrf=?", csrfToken).Scan(&userid)
+	return userid, err
+}
+
+func getUserId(w http.ResponseWriter, r *http.Request) (int, error) {
+	userid, err := lookupUserId(r)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			lr := LoginResult{Result: false, CsrfToken: ""}
@@ -1196,17 +1419,91 @@ func getUserId(w http.ResponseWriter, r *http.Request) (int, error) {
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return -1, err
 		}
-		db.Close()
 	}
 	return userid, nil
 }
 
+// requireAdmin answers 403 unless the user is an administrator
+func requireAdmin(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userid, err := getUserId(w, r)
+	if err != nil {
+		return -1, false
+	}
+
+	db, _ := getDb()
+	defer db.Close()
+	var isAdmin bool
+	err = db.QueryRow("SELECT is_admin FROM users WHERE id = ?", userid).Scan(&isAdmin)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return -1, false
+	}
+	if !isAdmin {
+		http.Error(w, "Administrators only", http.StatusForbidden)
+		return -1, false
+	}
+	return userid, true
+}
+
 /////////////////////////////////////////////////////////////
 // Handler for external communication
 /////////////////////////////////////////////////////////////
 
+// elements whose content isn't text of the page
+var hiddenElements = func() []*regexp.Regexp {
+	var patterns []*regexp.Regexp
+	for _, tag := range []string{"head", "script", "style", "noscript", "template", "svg", "iframe"} {
+		patterns = append(patterns, regexp.MustCompile(`(?is)<`+tag+`\b.*?</`+tag+`\s*>`))
+	}
+	return append(patterns, regexp.MustCompile(`(?s)<!--.*?-->`))
+}()
+
+var htmlTag = regexp.MustCompile(`(?s)<(/?)([a-zA-Z][a-zA-Z0-9]*)\b([^>]*)>`)
+
+var hrefAttribute = regexp.MustCompile(`(?is)\bhref\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+
+// tags which start a new line of text
+var blockTags = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "br": true, "dd": true, "div": true,
+	"dl": true, "dt": true, "footer": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true,
+	"h6": true, "header": true, "hr": true, "li": true, "main": true, "nav": true, "ol": true, "p": true,
+	"pre": true, "section": true, "table": true, "td": true, "th": true, "tr": true, "ul": true,
+}
+
+// removeTagsExceptA strips a page down to its text and its links, which are
+// kept as <a href="...">, with one line per block of text
 func removeTagsExceptA(htmlSource string) (string, error) {
-	return "broken", nil
+	for _, pattern := range hiddenElements {
+		htmlSource = pattern.ReplaceAllString(htmlSource, " ")
+	}
+	htmlSource = htmlTag.ReplaceAllStringFunc(htmlSource, func(tag string) string {
+		parts := htmlTag.FindStringSubmatch(tag)
+		name := strings.ToLower(parts[2])
+		if name == "a" {
+			if parts[1] == "/" {
+				return "</a>"
+			}
+			href := hrefAttribute.FindStringSubmatch(parts[3])
+			if href == nil {
+				return "<a>"
+			}
+			return `<a href="` + href[1] + href[2] + href[3] + `">`
+		}
+		if blockTags[name] {
+			return "\n"
+		}
+		return " "
+	})
+	htmlSource = html.UnescapeString(htmlSource)
+
+	var lines []string
+	for _, line := range strings.Split(htmlSource, "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
 }
 
 func searchHandler(w http.ResponseWriter, r *http.Request) {
@@ -1214,6 +1511,13 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	uid, err := getUserId(w, r)
+	if err != nil {
+		return
+	}
+	if !enforceLimits(w, uid, false) {
+		return
+	}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
@@ -1228,6 +1532,26 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	response, err := searxSearch(r.Context(), query.Query)
+	if err != nil {
+		fmt.Printf("Failed to search: %v", err)
+		return
+	}
+
+	responseBody, err := json.Marshal(response)
+	if err != nil {
+		fmt.Printf("Failed to marshal response: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseBody)
+}
+
+// searxSearch queries SearxNG and keeps the first MAX_SEARCH_HITS hits
+func searxSearch(ctx context.Context, query string) (SearxResultRedux, error) {
+	var response SearxResultRedux
+
 	// Create custom HTTP client with a 10-minute timeout
 	client := &http.Client{
 		Timeout: 10 * time.Minute,
@@ -1235,33 +1559,29 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Create a new request
 	//searchURL := fmt.Sprintf("http://searx.local:8888/search?q=%s&format=json", url.QueryEscape(query.Query))
-	searchURL := fmt.Sprintf(os.Getenv("SEARX")+"/search?q=%s&format=json", url.QueryEscape(query.Query))
-	req, err := http.NewRequest("GET", searchURL, nil)
+	searchURL := fmt.Sprintf(os.Getenv("SEARX")+"/search?q=%s&format=json", url.QueryEscape(query))
+	req, err := http.NewRequestWithContext(ctx, "GET", searchURL, nil)
 	if err != nil {
-		fmt.Printf("Failed to create new request: %v", err)
-		return
+		return response, fmt.Errorf("failed to create new request: %v", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	// Perform the request
 	resp, err := client.Do(req)
 	if err != nil {
-		fmt.Printf("Failed to make PS request to external service: %v", err)
-		return
+		return response, fmt.Errorf("failed to make search request to external service: %v", err)
 	}
 	defer resp.Body.Close()
 
 	responseBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Printf("Failed to read response from external service: %v", err)
-		return
+		return response, fmt.Errorf("failed to read response from external service: %v", err)
 	}
 	var fullResults SearxResult
 
 	err = json.Unmarshal(responseBody, &fullResults)
 	if err != nil {
-		fmt.Printf("Failed to unmarshal response from external service: %v", err)
-		return
+		return response, fmt.Errorf("failed to unmarshal response from external service: %v", err)
 	}
 
 	var searxHitsRedux []SearxHitsRedux
@@ -1282,21 +1602,13 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	response := SearxResultRedux{
+	response = SearxResultRedux{
 		Results:     searxHitsRedux,
 		Answers:     fullResults.Answers,
 		Corrections: fullResults.Corrections,
 		Suggestions: fullResults.Suggestions,
 	}
-
-	responseBody, err = json.Marshal(response)
-	if err != nil {
-		fmt.Printf("Failed to marshal response: %v", err)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(responseBody)
+	return response, nil
 }
 
 func fetchHandler(w http.ResponseWriter, r *http.Request) {
@@ -1307,6 +1619,13 @@ func fetchHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write(msg)
 		return
 	}
+	uid, err := getUserId(w, r)
+	if err != nil {
+		return
+	}
+	if !enforceLimits(w, uid, false) {
+		return
+	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -1323,60 +1642,52 @@ func fetchHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write(msg)
 		return
 	}
-	fetchUrl := payload.Url
+	urlResponse := fetchPage(r.Context(), &http.Client{Timeout: FETCH_TIMEOUT}, payload.Url)
+
+	response, err := json.Marshal(urlResponse)
+	if err != nil {
+		msg, _ := json.Marshal(UrlResponse{Content: "Failed to marshal response", ReturnCode: http.StatusInternalServerError})
+		w.Write(msg)
+		return
+	}
+
+	w.Write(response)
+}
 
+// fetchPage retrieves a web page and strips it down to its text and links.
+// Failures are described in the returned UrlResponse.
+func fetchPage(ctx context.Context, client *http.Client, fetchUrl string) UrlResponse {
 	fetchUrl = strings.ReplaceAll(fetchUrl, "'", "")
 	fetchUrl = strings.ReplaceAll(fetchUrl, "`", "")
 	fetchUrl = strings.ReplaceAll(fetchUrl, "\"", "")
 	fetchUrl = strings.ReplaceAll(fetchUrl, "'", "")
 
 	fmt.Printf("fetchUrl: %s\n", fetchUrl)
-	// Create custom HTTP client with a 100 Second timeout (to avoid cloudflare timeouts)
-	client := &http.Client{
-		Timeout: 100 * time.Second,
-	}
 
 	// Create a new request
-	req, err := http.NewRequest("GET", fetchUrl, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", fetchUrl, nil)
 	if err != nil {
-		msg, _ := json.Marshal(UrlResponse{Content: "Failed to create new request", ReturnCode: http.StatusInternalServerError})
-		w.Write(msg)
-		return
+		return UrlResponse{Content: "Failed to create new request", ReturnCode: http.StatusInternalServerError}
 	}
 
 	// Perform the request
 	resp, err := client.Do(req)
 	if err != nil {
-		msg, _ := json.Marshal(UrlResponse{Content: "Failed to make request to external URL", ReturnCode: http.StatusInternalServerError})
-		w.Write(msg)
-		return
+		return UrlResponse{Content: "Failed to make request to external URL", ReturnCode: http.StatusInternalServerError}
 	}
 	defer resp.Body.Close()
 
 	responseBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		msg, _ := json.Marshal(UrlResponse{Content: "Failed to read response from external service", ReturnCode: http.StatusInternalServerError})
-		w.Write(msg)
-		return
+		return UrlResponse{Content: "Failed to read response from external service", ReturnCode: http.StatusInternalServerError}
 	}
 
 	parsedResponse, err := removeTagsExceptA(string(responseBody))
 	if err != nil {
-		msg, _ := json.Marshal(UrlResponse{Content: "Failed to parse HTML response", ReturnCode: http.StatusInternalServerError})
-		w.Write(msg)
-		return
-	}
-
-	urlResponse := UrlResponse{Content: parsedResponse, ReturnCode: 200}
-
-	response, err := json.Marshal(urlResponse)
-	if err != nil {
-		msg, _ := json.Marshal(UrlResponse{Content: "Failed to marshal response", ReturnCode: http.StatusInternalServerError})
-		w.Write(msg)
-		return
+		return UrlResponse{Content: "Failed to parse HTML response", ReturnCode: http.StatusInternalServerError}
 	}
 
-	w.Write(response)
+	return UrlResponse{Content: parsedResponse, ReturnCode: 200}
 }
 
 // ///////////////////////////////////////////////////////////
@@ -1432,15 +1743,45 @@ func getDb() (*sql.DB, error) {
 	return db, nil
 }
 
+// writeJSON answers with a value encoded as JSON
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	jsonRes, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonRes)
+}
+
 func main() {
 	fmt.Println("Listening on port 32225")
 
 	http.HandleFunc("/async/chat", chatHandler)
 	http.HandleFunc("/async/response", responseHandler)
+	http.HandleFunc("/async/stream", streamHandler)
+	http.HandleFunc("/async/cancel", cancelHandler)
+	http.HandleFunc("/async/queue", queueHandler)
+	http.HandleFunc("/async/quota", quotaHandler)
+	http.HandleFunc("/async/janitor", janitorHandler)
 
 	http.HandleFunc("/async/ps", psHandler)
 	http.HandleFunc("/async/tags", tagsHandler)
+	http.HandleFunc("/async/capabilities", capabilitiesHandler)
 	http.HandleFunc("/async/unload", unloadHandler)
+	http.HandleFunc("/async/model/load", loadModelHandler)
+	http.HandleFunc("/async/model/unload", unloadHandler)
+	http.HandleFunc("/async/model/pin", pinModelHandler)
+	http.HandleFunc("/async/model/pull", pullModelHandler)
+	http.HandleFunc("/async/model/delete", deleteModelHandler)
+	http.HandleFunc("/async/model/history", modelHistoryHandler)
+	http.HandleFunc("/async/backends", backendsHandler)
+
+	http.HandleFunc("/async/conversations", conversationsHandler)
+	http.HandleFunc("/async/conversation", conversationHandler)
+	http.HandleFunc("/async/personas", personasHandler)
+	http.HandleFunc("/async/persona", personaHandler)
 
 	http.HandleFunc("/async/storeChatLog", storeChatLogHandler)
 	http.HandleFunc("/async/getChatLog", getChatLogHandler)
@@ -1451,8 +1792,22 @@ func main() {
 	http.HandleFunc("/async/search", searchHandler)
 	http.HandleFunc("/async/fetch", fetchHandler)
 
+	http.HandleFunc("/v1/chat/completions", openAIChatHandler)
+	http.HandleFunc("/v1/models", openAIModelsHandler)
+
 	http.HandleFunc("/async/login", loginHandler)
 	http.HandleFunc("/async/loginByCsrf", loginByCsrfHandler)
 	http.HandleFunc("/", healthChkHandler)
+
+	if os.Getenv("WEBHOOK_SECRET") == "" {
+		fmt.Println("WEBHOOK_SECRET is not set, chat requests with a callback_url are refused")
+	}
+
+	migrateDb()
+	checkBackends()
+	go runHealthChecks()
+	recoverOrphanedJobs()
+	loadQueuedJobs()
+	go runJanitor()
 	log.Fatal(http.ListenAndServe("0.0.0.0:32225", nil))
 }
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ModelRequest is the body of the model lifecycle endpoints. KeepAlive is
+// passed as is to Ollama, so both seconds and durations like "10m" work.
+type ModelRequest struct {
+	Model     string      `json:"model"`
+	KeepAlive interface{} `json:"keep_alive,omitempty"`
+	Pinned    bool        `json:"pinned"`
+	Host      string      `json:"host"`
+}
+
+// PullProgress is a line of the NDJSON stream of /api/pull, tagged with the
+// backend it comes from
+type PullProgress struct {
+	Host      string `json:"host"`
+	Status    string `json:"status"`
+	Digest    string `json:"digest,omitempty"`
+	Total     int64  `json:"total,omitempty"`
+	Completed int64  `json:"completed,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ModelOperation is an entry of the pull and delete history
+type ModelOperation struct {
+	Id         int64      `json:"id"`
+	UserId     int        `json:"user_id"`
+	Action     string     `json:"action"`
+	Model      string     `json:"model"`
+	Host       string     `json:"host"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// amount of entries returned by /async/model/history
+const MODEL_HISTORY_LENGTH = 100
+
+// body of an /api/generate call without prompt, which only (un)loads a model
+type keepAliveRequest struct {
+	Model     string      `json:"model"`
+	KeepAlive interface{} `json:"keep_alive,omitempty"`
+}
+
+// keep_alive telling Ollama to keep a model loaded forever
+const KEEP_ALIVE_FOREVER = -1
+
+// validKeepAlive accepts what Ollama does: seconds, as a number or a string,
+// or a duration like "10m". nil leaves it to Ollama.
+func validKeepAlive(keepAlive interface{}) bool {
+	switch value := keepAlive.(type) {
+	case nil, float64, int:
+		return true
+	case string:
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			return true
+		}
+		_, err := time.ParseDuration(value)
+		return err == nil
+	}
+	return false
+}
+
+// keep_alive is stored as text, NULL when unset
+func marshalKeepAlive(keepAlive interface{}) sql.NullString {
+	switch value := keepAlive.(type) {
+	case nil:
+		return sql.NullString{}
+	case string:
+		return sql.NullString{String: value, Valid: true}
+	default:
+		return sql.NullString{String: fmt.Sprint(value), Valid: true}
+	}
+}
+
+func unmarshalKeepAlive(stored sql.NullString) interface{} {
+	if !stored.Valid {
+		return nil
+	}
+	if seconds, err := strconv.ParseFloat(stored.String, 64); err == nil {
+		return seconds
+	}
+	return stored.String
+}
+
+func readModelRequest(w http.ResponseWriter, r *http.Request) (ModelRequest, bool) {
+	var request ModelRequest
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return request, false
+	}
+	_, err := getUserId(w, r)
+	if err != nil {
+		return request, false
+	}
+	return decodeModelRequest(w, r)
+}
+
+func decodeModelRequest(w http.ResponseWriter, r *http.Request) (ModelRequest, bool) {
+	var request ModelRequest
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		return request, false
+	}
+	defer r.Body.Close()
+	err = json.Unmarshal(body, &request)
+	if err != nil || request.Model == "" {
+		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return request, false
+	}
+	if !validKeepAlive(request.KeepAlive) {
+		http.Error(w, "keep_alive must be seconds or a duration like \"10m\"", http.StatusBadRequest)
+		return request, false
+	}
+	return request, true
+}
+
+// writeModelState answers with the models loaded on the backends
+func writeModelState(w http.ResponseWriter) {
+	writeJSON(w, getCurrentModelList())
+}
+
+// loadModel loads a model on the backend it would be routed to
+func loadModel(model string, keepAlive interface{}) error {
+	body, err := json.Marshal(keepAliveRequest{Model: model, KeepAlive: keepAlive})
+	if err != nil {
+		return err
+	}
+	backend, err := pickBackend(model, nil)
+	if err != nil {
+		return err
+	}
+	_, err = ollamaRequestOn(backend, "POST", "/api/generate", body, 10*time.Minute)
+	backend.check()
+	return err
+}
+
+// unloadModel unloads a model from every backend having it loaded
+func unloadModel(model string) error {
+	body, err := json.Marshal(keepAliveRequest{Model: model, KeepAlive: 0})
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, backend := range healthyBackends() {
+		models, err := backend.fetchPs(HEALTH_CHECK_TIMEOUT)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, loaded := range models.Models {
+			if loaded.Name != model {
+				continue
+			}
+			_, err = ollamaRequestOn(backend, "POST", "/api/generate", body, time.Minute)
+			if err != nil {
+				lastErr = err
+			}
+			backend.check()
+		}
+	}
+	return lastErr
+}
+
+func isPinned(model string) bool {
+	db, _ := getDb()
+	defer db.Close()
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM pinned_models WHERE model = ?", model).Scan(&count)
+	if err != nil {
+		fmt.Printf("Failed to read pinned models: %v", err)
+		return false
+	}
+	return count > 0
+}
+
+func pinnedModels() []string {
+	db, _ := getDb()
+	defer db.Close()
+	models := []string{}
+	rows, err := db.Query("SELECT model FROM pinned_models ORDER BY model")
+	if err != nil {
+		fmt.Printf("Failed to read pinned models: %v", err)
+		return models
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var model string
+		if rows.Scan(&model) == nil {
+			models = append(models, model)
+		}
+	}
+	return models
+}
+
+// maintainPins reloads the pinned models which aren't resident on any healthy
+// backend anymore, e.g. after a restart of Ollama
+func maintainPins() {
+	for _, model := range pinnedModels() {
+		if isResident(model) {
+			continue
+		}
+		fmt.Println("Reloading pinned model " + model)
+		err := loadModel(model, KEEP_ALIVE_FOREVER)
+		if err != nil {
+			fmt.Printf("Failed to reload pinned model %s: %v\n", model, err)
+		}
+	}
+}
+
+// isResident tells whether a healthy backend had the model loaded at its
+// last check
+func isResident(model string) bool {
+	for _, backend := range healthyBackends() {
+		backend.mu.Lock()
+		loaded := backend.loaded[model]
+		backend.mu.Unlock()
+		if loaded {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler for the /async/model/load endpoint
+func loadModelHandler(w http.ResponseWriter, r *http.Request) {
+	request, ok := readModelRequest(w, r)
+	if !ok {
+		return
+	}
+	keepAlive := request.KeepAlive
+	if isPinned(request.Model) {
+		keepAlive = KEEP_ALIVE_FOREVER
+	}
+	err := loadModel(request.Model, keepAlive)
+	if err != nil {
+		fmt.Printf("Failed to load %s: %v", request.Model, err)
+		http.Error(w, fmt.Sprintf("Failed to load %s: %v", request.Model, err), http.StatusBadGateway)
+		return
+	}
+	writeModelState(w)
+}
+
+// Handler for the /async/unload and /async/model/unload endpoints. Unloading
+// a model also unpins it.
+func unloadHandler(w http.ResponseWriter, r *http.Request) {
+	request, ok := readModelRequest(w, r)
+	if !ok {
+		return
+	}
+	db, _ := getDb()
+	_, err := db.Exec("DELETE FROM pinned_models WHERE model = ?", request.Model)
+	db.Close()
+	if err != nil {
+		fmt.Printf("Failed to unpin %s: %v", request.Model, err)
+	}
+	err = unloadModel(request.Model)
+	if err != nil {
+		fmt.Printf("Failed to unload %s: %v", request.Model, err)
+		http.Error(w, fmt.Sprintf("Failed to unload %s: %v", request.Model, err), http.StatusBadGateway)
+		return
+	}
+	writeModelState(w)
+}
+
+// Handler for the /async/model/pin endpoint. Pinned models are loaded with
+// an infinite keep_alive, which every later request for them keeps.
+// Unpinning hands the model back to Ollama's default keep_alive.
+func pinModelHandler(w http.ResponseWriter, r *http.Request) {
+	request, ok := readModelRequest(w, r)
+	if !ok {
+		return
+	}
+	db, _ := getDb()
+	var err error
+	if request.Pinned {
+		_, err = db.Exec("INSERT IGNORE INTO pinned_models (model, pinned_at) VALUES (?, ?)", request.Model, time.Now())
+	} else {
+		_, err = db.Exec("DELETE FROM pinned_models WHERE model = ?", request.Model)
+	}
+	db.Close()
+	if err != nil {
+		fmt.Printf("Failed to pin %s: %v", request.Model, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	var keepAlive interface{}
+	if request.Pinned {
+		keepAlive = KEEP_ALIVE_FOREVER
+	} else if !isResident(request.Model) {
+		writeModelState(w)
+		return
+	}
+	err = loadModel(request.Model, keepAlive)
+	if err != nil {
+		fmt.Printf("Failed to load %s: %v", request.Model, err)
+		http.Error(w, fmt.Sprintf("Failed to load %s: %v", request.Model, err), http.StatusBadGateway)
+		return
+	}
+	writeModelState(w)
+}
+
+// targetBackends returns the configured backend named host, or all the
+// healthy ones if host is empty
+func targetBackends(host string) []*ollamaBackend {
+	if host == "" {
+		return healthyBackends()
+	}
+	for _, backend := range backends {
+		if backend.Host == host {
+			return []*ollamaBackend{backend}
+		}
+	}
+	return nil
+}
+
+// startModelOperation records a pull or delete in the history
+func startModelOperation(userId int, action string, model string, host string) int64 {
+	db, _ := getDb()
+	defer db.Close()
+	result, err := db.Exec("INSERT INTO model_history (user_id, action, model, host, status, started_at) VALUES (?, ?, ?, ?, 'running', ?)", userId, action, model, host, time.Now())
+	if err != nil {
+		fmt.Printf("Failed to record %s of %s: %v", action, model, err)
+		return 0
+	}
+	id, _ := result.LastInsertId()
+	return id
+}
+
+func finishModelOperation(id int64, err error) {
+	status, errMsg := "success", ""
+	if err != nil {
+		status, errMsg = "failed", err.Error()
+	}
+	db, _ := getDb()
+	defer db.Close()
+	_, dbErr := db.Exec("UPDATE model_history SET status = ?, error = ?, finished_at = ? WHERE id = ?", status, errMsg, time.Now(), id)
+	if dbErr != nil {
+		fmt.Printf("Failed to record outcome of model operation %d: %v", id, dbErr)
+	}
+}
+
+func loadModelOperation(id int64) ModelOperation {
+	var op ModelOperation
+	var errMsg sql.NullString
+	var finishedAt sql.NullTime
+	db, _ := getDb()
+	defer db.Close()
+	err := db.QueryRow("SELECT id, user_id, action, model, host, status, error, started_at, finished_at FROM model_history WHERE id = ?", id).
+		Scan(&op.Id, &op.UserId, &op.Action, &op.Model, &op.Host, &op.Status, &errMsg, &op.StartedAt, &finishedAt)
+	if err != nil {
+		fmt.Printf("Failed to read model operation %d: %v", id, err)
+	}
+	op.Error = errMsg.String
+	if finishedAt.Valid {
+		op.FinishedAt = &finishedAt.Time
+	}
+	return op
+}
+
+// pullOnBackend pulls a model on a backend, handing every progress line of
+// Ollama to progress
+func pullOnBackend(backend *ollamaBackend, model string, progress func(PullProgress)) error {
+	body, err := json.Marshal(map[string]interface{}{"model": model, "stream": true})
+	if err != nil {
+		return err
+	}
+	// no timeout, large models take a while
+	req, err := http.NewRequest("POST", backend.Host+"/api/pull", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		errorBody, _ := io.ReadAll(resp.Body)
+		return &backendStatusError{StatusCode: resp.StatusCode, Body: string(errorBody)}
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var update PullProgress
+			if jsonErr := json.Unmarshal(line, &update); jsonErr != nil {
+				return fmt.Errorf("failed to unmarshal pull progress: %v", jsonErr)
+			}
+			update.Host = backend.Host
+			progress(update)
+			if update.Error != "" {
+				return fmt.Errorf("%s", update.Error)
+			}
+			if update.Status == "success" {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return fmt.Errorf("pull ended without success")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Handler for the /async/model/pull endpoint, admin only. The progress of
+// Ollama is relayed as Server-Sent Events: "progress" events, followed by a
+// "result" event per backend carrying the ModelOperation recorded in the
+// history. The pull goes on if the client disconnects.
+func pullModelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userId, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	request, ok := decodeModelRequest(w, r)
+	if !ok {
+		return
+	}
+	targets := targetBackends(request.Host)
+	if len(targets) == 0 {
+		http.Error(w, "No such backend", http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	for _, backend := range targets {
+		id := startModelOperation(userId, "pull", request.Model, backend.Host)
+		err := pullOnBackend(backend, request.Model, func(update PullProgress) {
+			writeEvent(w, "progress", update)
+			flusher.Flush()
+		})
+		if err != nil {
+			fmt.Printf("Failed to pull %s on %s: %v\n", request.Model, backend.Host, err)
+		}
+		forgetCapabilities(request.Model)
+		finishModelOperation(id, err)
+		writeEvent(w, "result", loadModelOperation(id))
+		flusher.Flush()
+	}
+}
+
+// Handler for the /async/model/delete endpoint, admin only. Answers with the
+// ModelOperation recorded for each backend.
+func deleteModelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userId, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	request, ok := decodeModelRequest(w, r)
+	if !ok {
+		return
+	}
+	targets := targetBackends(request.Host)
+	if len(targets) == 0 {
+		http.Error(w, "No such backend", http.StatusBadRequest)
+		return
+	}
+
+	body, err := json.Marshal(map[string]string{"model": request.Model})
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	operations := []ModelOperation{}
+	for _, backend := range targets {
+		id := startModelOperation(userId, "delete", request.Model, backend.Host)
+		_, err := ollamaRequestOn(backend, "DELETE", "/api/delete", body, time.Minute)
+		if err != nil {
+			fmt.Printf("Failed to delete %s on %s: %v\n", request.Model, backend.Host, err)
+		}
+		forgetCapabilities(request.Model)
+		finishModelOperation(id, err)
+		operations = append(operations, loadModelOperation(id))
+	}
+
+	jsonRes, err := json.Marshal(operations)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonRes)
+}
+
+// Handler for the /async/model/history endpoint
+func modelHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := getUserId(w, r)
+	if err != nil {
+		return
+	}
+
+	db, _ := getDb()
+	defer db.Close()
+	rows, err := db.Query("SELECT id, user_id, action, model, host, status, error, started_at, finished_at FROM model_history ORDER BY id DESC LIMIT ?", MODEL_HISTORY_LENGTH)
+	if err != nil {
+		fmt.Printf("Failed to read model history: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	operations := []ModelOperation{}
+	for rows.Next() {
+		var op ModelOperation
+		var errMsg sql.NullString
+		var finishedAt sql.NullTime
+		err = rows.Scan(&op.Id, &op.UserId, &op.Action, &op.Model, &op.Host, &op.Status, &errMsg, &op.StartedAt, &finishedAt)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		op.Error = errMsg.String
+		if finishedAt.Valid {
+			op.FinishedAt = &finishedAt.Time
+		}
+		operations = append(operations, op)
+	}
+
+	jsonRes, err := json.Marshal(operations)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonRes)
+}
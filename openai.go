@@ -0,0 +1,450 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// openAIChatRequest is the body of /v1/chat/completions. conversation_id,
+// persona_id and log_chat are extensions, the rest follows OpenAI.
+type openAIChatRequest struct {
+	Model          string                `json:"model"`
+	Messages       []openAIMessage       `json:"messages"`
+	Stream         bool                  `json:"stream"`
+	Temperature    *float64              `json:"temperature"`
+	TopP           *float64              `json:"top_p"`
+	MaxTokens      *int                  `json:"max_tokens"`
+	MaxCompletion  *int                  `json:"max_completion_tokens"`
+	Stop           json.RawMessage       `json:"stop"`
+	Seed           *int                  `json:"seed"`
+	ResponseFormat *openAIResponseFormat `json:"response_format"`
+	ConversationId int                   `json:"conversation_id"`
+	PersonaId      int                   `json:"persona_id"`
+	LogChat        bool                  `json:"log_chat"`
+}
+
+// openAIMessage has a content which is either a string or a list of text
+// and image_url parts
+type openAIMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+type openAIContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	ImageURL struct {
+		URL string `json:"url"`
+	} `json:"image_url"`
+}
+
+type openAIResponseFormat struct {
+	Type       string `json:"type"`
+	JSONSchema struct {
+		Schema json.RawMessage `json:"schema"`
+	} `json:"json_schema"`
+}
+
+type openAICompletion struct {
+	Id      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []openAIChoice `json:"choices"`
+	Usage   *openAIUsage   `json:"usage,omitempty"`
+}
+
+// openAIChoice carries a message in completions and a delta in chunks
+type openAIChoice struct {
+	Index        int                  `json:"index"`
+	Message      *openAIAnswerMessage `json:"message,omitempty"`
+	Delta        *openAIAnswerMessage `json:"delta,omitempty"`
+	FinishReason *string              `json:"finish_reason"`
+}
+
+type openAIAnswerMessage struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+type openAIUsage struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	TotalTokens      int64 `json:"total_tokens"`
+}
+
+type openAIError struct {
+	Error openAIErrorDetail `json:"error"`
+}
+
+type openAIErrorDetail struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
+
+type openAIModel struct {
+	Id      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+type openAIModelList struct {
+	Object string        `json:"object"`
+	Data   []openAIModel `json:"data"`
+}
+
+func writeOpenAIError(w http.ResponseWriter, status int, message string) {
+	errorType := "invalid_request_error"
+	if status == http.StatusTooManyRequests {
+		errorType = "rate_limit_error"
+	} else if status >= http.StatusInternalServerError {
+		errorType = "server_error"
+	}
+	jsonRes, _ := json.Marshal(openAIError{Error: openAIErrorDetail{Message: message, Type: errorType}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonRes)
+}
+
+// openAIUserId authenticates a request by its API key, answering failures
+// the way OpenAI does
+func openAIUserId(w http.ResponseWriter, r *http.Request) (int, bool) {
+	uid, err := lookupUserId(r)
+	if err == sql.ErrNoRows {
+		writeOpenAIError(w, http.StatusUnauthorized, "Invalid API key")
+		return -1, false
+	}
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "Internal Server Error")
+		return -1, false
+	}
+	return uid, true
+}
+
+// openAIContent splits the content of a message into its text and images
+func openAIContent(content json.RawMessage) (string, []string, error) {
+	if len(content) == 0 || string(content) == "null" {
+		return "", nil, nil
+	}
+	var text string
+	if json.Unmarshal(content, &text) == nil {
+		return text, nil, nil
+	}
+	var parts []openAIContentPart
+	if err := json.Unmarshal(content, &parts); err != nil {
+		return "", nil, errors.New("content must be a string or a list of parts")
+	}
+	var texts, images []string
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			texts = append(texts, part.Text)
+		case "image_url":
+			if !strings.HasPrefix(part.ImageURL.URL, "data:") {
+				return "", nil, errors.New("images must be sent as data URLs")
+			}
+			images = append(images, part.ImageURL.URL)
+		default:
+			return "", nil, fmt.Errorf("unsupported content part %q", part.Type)
+		}
+	}
+	return strings.Join(texts, "\n"), images, nil
+}
+
+// openAIPayload translates a chat completion request into the payload of
+// /async/chat
+func openAIPayload(request openAIChatRequest) (Payload, error) {
+	payload := Payload{
+		Model:          request.Model,
+		ConversationId: request.ConversationId,
+		PersonaId:      request.PersonaId,
+		LogChat:        request.LogChat,
+	}
+	for _, message := range request.Messages {
+		role := message.Role
+		if role == "developer" {
+			role = "system"
+		}
+		content, images, err := openAIContent(message.Content)
+		if err != nil {
+			return payload, err
+		}
+		payload.Messages = append(payload.Messages, Messages{Role: role, Content: content, Images: images})
+	}
+
+	options := ModelOptions{Temperature: request.Temperature, TopP: request.TopP, Seed: request.Seed}
+	options.NumPredict = request.MaxTokens
+	if request.MaxCompletion != nil {
+		options.NumPredict = request.MaxCompletion
+	}
+	if len(request.Stop) > 0 && string(request.Stop) != "null" {
+		var stop string
+		if json.Unmarshal(request.Stop, &stop) == nil {
+			options.Stop = []string{stop}
+		} else if json.Unmarshal(request.Stop, &options.Stop) != nil {
+			return payload, errors.New("stop must be a string or a list of strings")
+		}
+	}
+	if !options.isEmpty() {
+		payload.Options = &options
+	}
+
+	if request.ResponseFormat != nil {
+		switch request.ResponseFormat.Type {
+		case "text":
+		case "json_object":
+			payload.Format = json.RawMessage(`"json"`)
+		case "json_schema":
+			if len(request.ResponseFormat.JSONSchema.Schema) == 0 {
+				return payload, errors.New("json_schema needs a schema")
+			}
+			payload.Format = request.ResponseFormat.JSONSchema.Schema
+		default:
+			return payload, fmt.Errorf("unsupported response_format %q", request.ResponseFormat.Type)
+		}
+	}
+	return payload, nil
+}
+
+func finishReason(answer *LLMAnswer) *string {
+	reason := "stop"
+	if answer != nil && answer.DoneReason == "length" {
+		reason = "length"
+	}
+	return &reason
+}
+
+func openAIUsageOf(answer *LLMAnswer) *openAIUsage {
+	return &openAIUsage{
+		PromptTokens:     answer.PromptEvalCount,
+		CompletionTokens: answer.EvalCount,
+		TotalTokens:      answer.PromptEvalCount + answer.EvalCount,
+	}
+}
+
+// forgetJob removes a job whose answer has been handed out, as fetching it
+// from /async/response would
+func forgetJob(uuid string) {
+	db, _ := getDb()
+	defer db.Close()
+	_, err := db.Exec("DELETE FROM async WHERE uuid = ?", uuid)
+	if err != nil {
+		fmt.Printf("Failed to delete job %s: %v", uuid, err)
+	}
+	clearJobSteps(db, uuid)
+}
+
+// Handler for the /v1/models endpoint, listing the models of the backends
+// the way OpenAI does
+func openAIModelsHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := openAIUserId(w, r); !ok {
+		return
+	}
+	tags, err := getModelTags()
+	if err != nil {
+		fmt.Printf("Failed to make tags request to external service: %v", err)
+		writeOpenAIError(w, http.StatusBadGateway, "Failed to list models")
+		return
+	}
+
+	list := openAIModelList{Object: "list", Data: []openAIModel{}}
+	for _, tag := range tags.Models {
+		var created int64
+		if modifiedAt, err := time.Parse(time.RFC3339Nano, tag.ModifiedAt); err == nil {
+			created = modifiedAt.Unix()
+		}
+		list.Data = append(list.Data, openAIModel{Id: tag.Name, Object: "model", Created: created, OwnedBy: "ollama"})
+	}
+	jsonRes, _ := json.Marshal(list)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonRes)
+}
+
+// Handler for the /v1/chat/completions endpoint, letting OpenAI clients use
+// the companion. The request is queued like one of /async/chat, with the
+// same limits, memories and chat logging, and answered once done, or
+// streamed as chat.completion.chunk events with "stream": true. Should the
+// client go away before the answer, the job is cancelled unless it logs to
+// the chat.
+func openAIChatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+	uid, ok := openAIUserId(w, r)
+	if !ok {
+		return
+	}
+	if exceeded := checkLimits(uid, true); exceeded != nil {
+		w.Header().Set("Retry-After", exceeded.retryAfterHeader())
+		writeOpenAIError(w, http.StatusTooManyRequests, exceeded.Message)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "Failed to read request body")
+		return
+	}
+	defer r.Body.Close()
+	var request openAIChatRequest
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "Invalid JSON payload")
+		return
+	}
+	payload, err := openAIPayload(request)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	uniqueID, status, err := queueChat(uid, payload)
+	if err != nil {
+		writeOpenAIError(w, status, err.Error())
+		return
+	}
+	s := getStream(uniqueID)
+	if s == nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "Failed to follow the request")
+		return
+	}
+	completion := openAICompletion{Id: "chatcmpl-" + uniqueID, Created: time.Now().Unix(), Model: request.Model}
+
+	if request.Stream {
+		streamCompletion(w, r, uid, uniqueID, s, completion, hasFormat(payload.Format), payload.LogChat)
+		return
+	}
+
+	ch := s.subscribe()
+	defer s.unsubscribe(ch)
+	sent, resets := 0, 0
+	for {
+		snapshot := s.since(sent, resets)
+		if snapshot.Resets != resets {
+			sent, resets = 0, snapshot.Resets
+		}
+		sent += len(snapshot.Tokens)
+		if snapshot.Done {
+			if snapshot.ErrMsg != "" {
+				writeOpenAIError(w, http.StatusInternalServerError, snapshot.ErrMsg)
+			} else {
+				completion.Object = "chat.completion"
+				completion.Model = snapshot.Final.Model
+				completion.Choices = []openAIChoice{{
+					Message:      &openAIAnswerMessage{Role: "assistant", Content: snapshot.Final.Message.Content},
+					FinishReason: finishReason(snapshot.Final),
+				}}
+				completion.Usage = openAIUsageOf(snapshot.Final)
+				jsonRes, _ := json.Marshal(completion)
+				w.Header().Set("Content-Type", "application/json")
+				w.Write(jsonRes)
+			}
+			forgetJob(uniqueID)
+			return
+		}
+
+		select {
+		case <-ch:
+		case <-r.Context().Done():
+			if !payload.LogChat {
+				cancelChatJob(uniqueID, uid)
+			}
+			return
+		}
+	}
+}
+
+// streamCompletion relays a job as chat.completion.chunk events. Chunks
+// can't be taken back, so once the job starts over (on another backend or
+// after tool calls) the rest of the answer is only sent when done, as are
+// answers which must match a format and may be corrected. Should the final
+// answer not continue what was already sent, the stream ends with an error.
+func streamCompletion(w http.ResponseWriter, r *http.Request, uid int, uniqueID string, s *chatStream, completion openAICompletion, buffered bool, logChat bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeOpenAIError(w, http.StatusInternalServerError, "Streaming unsupported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	completion.Object = "chat.completion.chunk"
+	writeChunk := func(delta openAIAnswerMessage, reason *string) {
+		completion.Choices = []openAIChoice{{Delta: &delta, FinishReason: reason}}
+		jsonData, _ := json.Marshal(completion)
+		fmt.Fprintf(w, "data: %s\n\n", jsonData)
+	}
+	writeError := func(message string) {
+		jsonData, _ := json.Marshal(openAIError{Error: openAIErrorDetail{Message: message, Type: "server_error"}})
+		fmt.Fprintf(w, "data: %s\n\n", jsonData)
+	}
+	writeChunk(openAIAnswerMessage{Role: "assistant"}, nil)
+	flusher.Flush()
+
+	ch := s.subscribe()
+	defer s.unsubscribe(ch)
+	ticker := time.NewTicker(STREAM_KEEPALIVE)
+	defer ticker.Stop()
+
+	var streamed strings.Builder
+	sent, resets := 0, 0
+	for {
+		snapshot := s.since(sent, resets)
+		if snapshot.Resets != resets {
+			if streamed.Len() > 0 {
+				buffered = true
+			}
+			sent, resets = 0, snapshot.Resets
+		}
+		if !buffered {
+			for _, token := range snapshot.Tokens {
+				writeChunk(openAIAnswerMessage{Content: token}, nil)
+				streamed.WriteString(token)
+			}
+		}
+		sent += len(snapshot.Tokens)
+
+		if snapshot.Done {
+			if snapshot.ErrMsg != "" {
+				writeError(snapshot.ErrMsg)
+			} else if rest, ok := strings.CutPrefix(snapshot.Final.Message.Content, streamed.String()); !ok {
+				// the chunks sent before the job started over can't be
+				// taken back
+				fmt.Printf("Answer of job %s diverged from its stream\n", uniqueID)
+				writeError("the answer changed after it had been partly streamed, request it without streaming")
+			} else {
+				if rest != "" {
+					writeChunk(openAIAnswerMessage{Content: rest}, nil)
+				}
+				writeChunk(openAIAnswerMessage{}, finishReason(snapshot.Final))
+			}
+			fmt.Fprint(w, "data: [DONE]\n\n")
+			flusher.Flush()
+			forgetJob(uniqueID)
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-ch:
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			if !logChat {
+				cancelChatJob(uniqueID, uid)
+			}
+			return
+		}
+	}
+}
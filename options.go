@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+)
+
+// ModelOptions are the Ollama "options" of a request. Unset fields are left
+// out, so Ollama falls back to the defaults of the model.
+type ModelOptions struct {
+	NumCtx        *int     `json:"num_ctx,omitempty"`
+	NumPredict    *int     `json:"num_predict,omitempty"`
+	Temperature   *float64 `json:"temperature,omitempty"`
+	TopP          *float64 `json:"top_p,omitempty"`
+	TopK          *int     `json:"top_k,omitempty"`
+	Seed          *int     `json:"seed,omitempty"`
+	RepeatPenalty *float64 `json:"repeat_penalty,omitempty"`
+	Stop          []string `json:"stop,omitempty"`
+}
+
+// ollamaChatRequest is the body sent to /api/chat. Payload carries fields
+// for this service only, so it isn't sent as is.
+type ollamaChatRequest struct {
+	Model     string           `json:"model"`
+	Messages  []Messages       `json:"messages"`
+	Stream    bool             `json:"stream"`
+	KeepAlive interface{}      `json:"keep_alive,omitempty"`
+	Options   *ModelOptions    `json:"options,omitempty"`
+	Format    json.RawMessage  `json:"format,omitempty"`
+	Tools     []toolDefinition `json:"tools,omitempty"`
+}
+
+func floatOption(value float64) *float64 {
+	return &value
+}
+
+// withDefaults fills the options left unset from defaults
+func (o ModelOptions) withDefaults(defaults ModelOptions) ModelOptions {
+	if o.NumCtx == nil {
+		o.NumCtx = defaults.NumCtx
+	}
+	if o.NumPredict == nil {
+		o.NumPredict = defaults.NumPredict
+	}
+	if o.Temperature == nil {
+		o.Temperature = defaults.Temperature
+	}
+	if o.TopP == nil {
+		o.TopP = defaults.TopP
+	}
+	if o.TopK == nil {
+		o.TopK = defaults.TopK
+	}
+	if o.Seed == nil {
+		o.Seed = defaults.Seed
+	}
+	if o.RepeatPenalty == nil {
+		o.RepeatPenalty = defaults.RepeatPenalty
+	}
+	if o.Stop == nil {
+		o.Stop = defaults.Stop
+	}
+	return o
+}
+
+func (o ModelOptions) isEmpty() bool {
+	return o.NumCtx == nil && o.NumPredict == nil && o.Temperature == nil && o.TopP == nil &&
+		o.TopK == nil && o.Seed == nil && o.RepeatPenalty == nil && o.Stop == nil
+}
+
+// requestOptions returns the options of a chat request. The top level
+// temperature of older clients is used unless options.temperature is set.
+func requestOptions(payload Payload) *ModelOptions {
+	var options ModelOptions
+	if payload.Options != nil {
+		options = *payload.Options
+	}
+	if options.Temperature == nil && payload.Temperature != 0 {
+		options.Temperature = floatOption(payload.Temperature)
+	}
+	if options.isEmpty() {
+		return nil
+	}
+	return &options
+}
+
+// chatRequest turns a chat request into the body for /api/chat
+func chatRequest(payload Payload) ollamaChatRequest {
+	request := ollamaChatRequest{
+		Model:     payload.Model,
+		Messages:  payload.Messages,
+		Stream:    payload.Stream,
+		KeepAlive: payload.KeepAlive,
+		Options:   requestOptions(payload),
+		Format:    payload.Format,
+	}
+	if payload.UseTools {
+		request.Tools = chatTools
+	}
+	return request
+}
+
+// options are stored as JSON, NULL for none
+func marshalOptions(options ModelOptions) sql.NullString {
+	if options.isEmpty() {
+		return sql.NullString{}
+	}
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: string(encoded), Valid: true}
+}
+
+func unmarshalOptions(stored sql.NullString) ModelOptions {
+	var options ModelOptions
+	if stored.Valid && stored.String != "" {
+		json.Unmarshal([]byte(stored.String), &options)
+	}
+	return options
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type Persona struct {
+	Id           int          `json:"id"`
+	Name         string       `json:"name"`
+	SystemPrompt string       `json:"system_prompt"`
+	Model        string       `json:"model"`
+	Temperature  float64      `json:"temperature"`
+	KeepAlive    interface{}  `json:"keep_alive"` // seconds or a duration like "10m", null if unset
+	Options      ModelOptions `json:"options"`
+	Avatar       string       `json:"avatar"`
+}
+
+const personaColumns = "id, name, system_prompt, model, temperature, keep_alive, options, avatar"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPersona(row rowScanner) (Persona, error) {
+	var persona Persona
+	var keepAlive, options sql.NullString
+	err := row.Scan(&persona.Id, &persona.Name, &persona.SystemPrompt, &persona.Model, &persona.Temperature, &keepAlive, &options, &persona.Avatar)
+	persona.KeepAlive = unmarshalKeepAlive(keepAlive)
+	persona.Options = unmarshalOptions(options)
+	return persona, err
+}
+
+func loadPersona(db *sql.DB, userId int, personaId int) (Persona, error) {
+	return scanPersona(db.QueryRow("SELECT "+personaColumns+" FROM personas WHERE id = ? AND user_id = ?", personaId, userId))
+}
+
+// applyPersona completes a chat request with the persona's defaults: what
+// the client sent wins, except for the system prompt, which is the
+// persona's.
+func applyPersona(payload *Payload, persona Persona) {
+	if payload.Model == "" {
+		payload.Model = persona.Model
+	}
+	var options ModelOptions
+	if requested := requestOptions(*payload); requested != nil {
+		options = *requested
+	}
+	options = options.withDefaults(persona.Options)
+	if options.Temperature == nil && persona.Temperature != 0 {
+		options.Temperature = floatOption(persona.Temperature)
+	}
+	payload.Options = &options
+	if payload.KeepAlive == nil {
+		payload.KeepAlive = persona.KeepAlive
+	}
+	if persona.SystemPrompt != "" {
+		if len(payload.Messages) > 0 && payload.Messages[0].Role == "system" {
+			payload.Messages[0].Content = persona.SystemPrompt
+		} else {
+			system := Messages{Role: "system", Content: persona.SystemPrompt}
+			payload.Messages = append([]Messages{system}, payload.Messages...)
+		}
+	}
+	for i := range payload.Messages {
+		if payload.Messages[i].Persona == "" {
+			payload.Messages[i].Persona = persona.Name
+		}
+	}
+}
+
+func readPersona(w http.ResponseWriter, r *http.Request) (Persona, bool) {
+	var persona Persona
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		return persona, false
+	}
+	defer r.Body.Close()
+	err = json.Unmarshal(body, &persona)
+	if err != nil || persona.Name == "" {
+		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return persona, false
+	}
+	if !validKeepAlive(persona.KeepAlive) {
+		http.Error(w, "keep_alive must be seconds or a duration like \"10m\"", http.StatusBadRequest)
+		return persona, false
+	}
+	return persona, true
+}
+
+// Handler for the /async/personas endpoint: GET lists the personas of the
+// user, POST creates one
+func personasHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := getUserId(w, r)
+	if err != nil {
+		return
+	}
+	db, _ := getDb()
+	defer db.Close()
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := db.Query("SELECT "+personaColumns+" FROM personas WHERE user_id = ? ORDER BY name", userId)
+		if err != nil {
+			fmt.Printf("Failed to list personas: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		personas := []Persona{}
+		for rows.Next() {
+			persona, err := scanPersona(rows)
+			if err != nil {
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			personas = append(personas, persona)
+		}
+		writeJSON(w, personas)
+
+	case http.MethodPost:
+		persona, ok := readPersona(w, r)
+		if !ok {
+			return
+		}
+		now := time.Now()
+		result, err := db.Exec("INSERT INTO personas (user_id, name, system_prompt, model, temperature, keep_alive, options, avatar, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			userId, persona.Name, persona.SystemPrompt, persona.Model, persona.Temperature, marshalKeepAlive(persona.KeepAlive), marshalOptions(persona.Options), persona.Avatar, now, now)
+		if err != nil {
+			fmt.Printf("Failed to create persona: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		id, _ := result.LastInsertId()
+		persona.Id = int(id)
+		writeJSON(w, persona)
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Handler for the /async/persona?id=<id> endpoint: GET returns the persona,
+// PUT replaces it and DELETE removes it
+func personaHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := getUserId(w, r)
+	if err != nil {
+		return
+	}
+	personaId, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid persona id", http.StatusBadRequest)
+		return
+	}
+	db, _ := getDb()
+	defer db.Close()
+
+	switch r.Method {
+	case http.MethodGet:
+		persona, err := loadPersona(db, userId, personaId)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Persona not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, persona)
+
+	case http.MethodPut:
+		persona, ok := readPersona(w, r)
+		if !ok {
+			return
+		}
+		persona.Id = personaId
+		_, err := db.Exec("UPDATE personas SET name = ?, system_prompt = ?, model = ?, temperature = ?, keep_alive = ?, options = ?, avatar = ?, updated_at = ? WHERE id = ? AND user_id = ?",
+			persona.Name, persona.SystemPrompt, persona.Model, persona.Temperature, marshalKeepAlive(persona.KeepAlive), marshalOptions(persona.Options), persona.Avatar, time.Now(), personaId, userId)
+		if err != nil {
+			fmt.Printf("Failed to update persona: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		// RowsAffected is 0 for unchanged rows too, so check for existence
+		if _, err = loadPersona(db, userId, personaId); err == sql.ErrNoRows {
+			http.Error(w, "Persona not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, persona)
+
+	case http.MethodDelete:
+		result, err := db.Exec("DELETE FROM personas WHERE id = ? AND user_id = ?", personaId, userId)
+		if err != nil {
+			fmt.Printf("Failed to delete persona: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			http.Error(w, "Persona not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		http.Error(w, "Only GET, PUT and DELETE methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,583 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// amount of concurrent generations per model, unless overridden by the
+// WORKERS_PER_MODEL or MODEL_WORKERS environment variables
+const DEFAULT_WORKERS_PER_MODEL = 1
+
+// how long background work is held back after the last interactive chat job
+const BACKGROUND_GRACE = 30 * time.Second
+
+// amount of times a job interrupted by a restart gets started before giving up
+const MAX_JOB_ATTEMPTS = 3
+
+type chatJob struct {
+	UUID      string
+	UserId    int
+	Payload   Payload
+	QueuedAt  time.Time
+	StartedAt time.Time
+	stream    *chatStream
+}
+
+// QueuedJobInfo is an entry of the /async/queue listing. Position is 0 for
+// running jobs and EtaSeconds null as long as the model has no history.
+type QueuedJobInfo struct {
+	UniqueID   string     `json:"uniqueID"`
+	Model      string     `json:"model"`
+	State      string     `json:"state"`
+	Position   int        `json:"position"`
+	QueuedAt   time.Time  `json:"queued_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	Tokens     int        `json:"tokens"`
+	EtaSeconds *float64   `json:"eta_seconds"`
+}
+
+// backgroundTask is low priority work, like summarization and embedding,
+// which only runs while nobody is chatting
+type backgroundTask struct {
+	Name string
+	Run  func()
+}
+
+// jobQueue dispatches chat jobs in FIFO order to a bounded pool of workers
+// per model. The async table is the persistent copy of the queue, the
+// in-memory one only decides who is next.
+// Background tasks have their own lane and worker, which waits until no chat
+// job is queued or running and BACKGROUND_GRACE has passed since the last one.
+type jobQueue struct {
+	mu              sync.Mutex
+	cond            *sync.Cond
+	pending         map[string][]*chatJob
+	running         map[string]*chatJob
+	pools           map[string]bool
+	background      []backgroundTask
+	backgroundBusy  map[string]bool
+	backgroundPool  bool
+	lastInteractive time.Time
+}
+
+var queue = newJobQueue()
+
+func newJobQueue() *jobQueue {
+	q := &jobQueue{
+		pending:        make(map[string][]*chatJob),
+		running:        make(map[string]*chatJob),
+		pools:          make(map[string]bool),
+		backgroundBusy: make(map[string]bool),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// workerCount returns the pool size for a model. MODEL_WORKERS holds
+// per-model overrides as a comma separated list, e.g. "llama3:8b=2,qwen2:0.5b=1"
+func workerCount(model string) int {
+	count := DEFAULT_WORKERS_PER_MODEL
+	if n, err := strconv.Atoi(os.Getenv("WORKERS_PER_MODEL")); err == nil && n > 0 {
+		count = n
+	}
+	for _, entry := range strings.Split(os.Getenv("MODEL_WORKERS"), ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found || name != model {
+			continue
+		}
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			count = n
+		}
+	}
+	return count
+}
+
+func (q *jobQueue) enqueue(job *chatJob) {
+	model := job.Payload.Model
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending[model] = append(q.pending[model], job)
+	q.lastInteractive = time.Now()
+	if !q.pools[model] {
+		q.pools[model] = true
+		workers := workerCount(model)
+		fmt.Printf("Starting %d worker(s) for %s\n", workers, model)
+		for i := 0; i < workers; i++ {
+			go q.worker(model)
+		}
+	}
+	q.cond.Broadcast()
+}
+
+// next blocks until a job for the given model is available
+func (q *jobQueue) next(model string) *chatJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.pending[model]) == 0 {
+		q.cond.Wait()
+	}
+	job := q.pending[model][0]
+	q.pending[model] = q.pending[model][1:]
+	job.StartedAt = time.Now()
+	q.running[job.UUID] = job
+	return job
+}
+
+func (q *jobQueue) release(job *chatJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.running, job.UUID)
+	q.lastInteractive = time.Now()
+	q.cond.Broadcast()
+}
+
+// enqueueBackground queues a low priority task, unless a task with the same
+// name is already waiting or running
+func (q *jobQueue) enqueueBackground(name string, run func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.backgroundBusy[name] {
+		fmt.Println("Background task already queued: " + name)
+		return
+	}
+	q.backgroundBusy[name] = true
+	q.background = append(q.background, backgroundTask{Name: name, Run: run})
+	if !q.backgroundPool {
+		q.backgroundPool = true
+		go q.backgroundWorker()
+	}
+	q.cond.Broadcast()
+}
+
+// interactiveIdle tells since when chat is idle, must be called with q.mu held
+func (q *jobQueue) interactiveIdle() (bool, time.Duration) {
+	if len(q.running) > 0 {
+		return false, 0
+	}
+	for _, jobs := range q.pending {
+		if len(jobs) > 0 {
+			return false, 0
+		}
+	}
+	wait := BACKGROUND_GRACE - time.Since(q.lastInteractive)
+	return wait <= 0, wait
+}
+
+// nextBackground blocks until a background task is available and chat has
+// been idle for long enough
+func (q *jobQueue) nextBackground() backgroundTask {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// sync.Cond has no timeout, a timer wakes us up once the grace is over
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		idle, wait := q.interactiveIdle()
+		if idle && len(q.background) > 0 {
+			break
+		}
+		if wait > 0 {
+			if timer == nil {
+				timer = time.AfterFunc(wait, q.cond.Broadcast)
+			} else {
+				timer.Reset(wait)
+			}
+		}
+		q.cond.Wait()
+	}
+	task := q.background[0]
+	q.background = q.background[1:]
+	return task
+}
+
+func (q *jobQueue) backgroundWorker() {
+	for {
+		task := q.nextBackground()
+		fmt.Println("Running background task: " + task.Name)
+		task.Run()
+		q.mu.Lock()
+		delete(q.backgroundBusy, task.Name)
+		q.mu.Unlock()
+	}
+}
+
+// snapshot returns the running jobs and the waiting ones, in dispatch order,
+// of a model
+func (q *jobQueue) snapshot(model string) ([]*chatJob, []*chatJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var running []*chatJob
+	for _, job := range q.running {
+		if job.Payload.Model == model {
+			running = append(running, job)
+		}
+	}
+	return running, append([]*chatJob(nil), q.pending[model]...)
+}
+
+// models returns the models a user has jobs for
+func (q *jobQueue) models(userId int) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	seen := make(map[string]bool)
+	var models []string
+	for _, job := range q.running {
+		if job.UserId == userId && !seen[job.Payload.Model] {
+			seen[job.Payload.Model] = true
+			models = append(models, job.Payload.Model)
+		}
+	}
+	for model, jobs := range q.pending {
+		for _, job := range jobs {
+			if job.UserId == userId && !seen[model] {
+				seen[model] = true
+				models = append(models, model)
+			}
+		}
+	}
+	return models
+}
+
+// find returns a queued or running job
+func (q *jobQueue) find(uuid string) *chatJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if job, ok := q.running[uuid]; ok {
+		return job
+	}
+	for _, jobs := range q.pending {
+		for _, job := range jobs {
+			if job.UUID == uuid {
+				return job
+			}
+		}
+	}
+	return nil
+}
+
+// remove takes a job out of the queue before a worker picked it up
+func (q *jobQueue) remove(uuid string) *chatJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for model, jobs := range q.pending {
+		for i, job := range jobs {
+			if job.UUID == uuid {
+				q.pending[model] = append(jobs[:i:i], jobs[i+1:]...)
+				return job
+			}
+		}
+	}
+	return nil
+}
+
+func (q *jobQueue) worker(model string) {
+	for {
+		job := q.next(model)
+		runChatJob(job)
+		q.release(job)
+	}
+}
+
+func runChatJob(job *chatJob) {
+	// registered before claiming the row, so a cancel can't slip in between
+	ctx, release := registerJob(job.UUID)
+	defer release()
+
+	claimed, err := markJobRunning(job.UUID)
+	if err != nil {
+		fmt.Printf("Failed to start job %s: %v", job.UUID, err)
+		job.stream.finish(job.UUID, nil, "Failed to start job")
+		return
+	}
+	if !claimed {
+		// cancelled while waiting
+		job.stream.finish(job.UUID, nil, JOB_CANCELLED)
+		return
+	}
+
+	if job.Payload.UseTools {
+		db, _ := getDb()
+		clearJobSteps(db, job.UUID)
+		db.Close()
+	}
+
+	answer, err := asyncChatRequest(ctx, job.UUID, job.stream, job.Payload)
+	if answer.PromptEvalCount+answer.EvalCount > 0 {
+		// rounds which led nowhere count against the quota all the same
+		recordStats(job.UserId, answer)
+	}
+	if ctx.Err() != nil {
+		// cancelChatJob took care of the state and the webhook
+		fmt.Println("Job cancelled: " + job.UUID)
+		job.stream.finish(job.UUID, nil, JOB_CANCELLED)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Job %s failed: %v\n", job.UUID, err)
+		failJob(job, err.Error())
+		return
+	}
+
+	answerJson, err := json.Marshal(answer)
+	if err != nil {
+		fmt.Printf("Failed to marshal answer: %v", err)
+		failJob(job, "Failed to marshal answer")
+		return
+	}
+	notify := jobCallback(job, JOB_DONE, &answer, "")
+	done, err := markJobDone(job.UUID, string(answerJson))
+	if err != nil {
+		fmt.Printf("Failed to store answer of job %s: %v", job.UUID, err)
+	}
+	if job.Payload.LogChat {
+		logAnswer(job, answer)
+	}
+	if done {
+		notify()
+	}
+	job.stream.finish(job.UUID, &answer, "")
+}
+
+// failJob stores the failure of a job, reports it to its webhook and ends
+// its stream
+func failJob(job *chatJob, errMsg string) {
+	notify := jobCallback(job, JOB_FAILED, nil, errMsg)
+	failed, err := markJobFailed(job.UUID, errMsg)
+	if err != nil {
+		fmt.Printf("Failed to mark job %s as failed: %v", job.UUID, err)
+	}
+	if failed {
+		notify()
+	}
+	job.stream.finish(job.UUID, nil, errMsg)
+}
+
+// logAnswer stores the answer of a job with log_chat in chat_log
+func logAnswer(job *chatJob, answer LLMAnswer) {
+	message := answer.Message
+	message.Role = "assistant"
+	message.Persona = assistantPersona(job.Payload)
+	db, _ := getDb()
+	defer db.Close()
+	err := logChatTurn(db, job.UserId, job.Payload.ConversationId, job.UUID, job.Payload.Model, message)
+	if err != nil {
+		fmt.Printf("Failed to log the answer of job %s: %v", job.UUID, err)
+	}
+}
+
+// submitChatJob stores a new job in the async table and queues it. With
+// log_chat, userTurn is the prompt as the user wrote it, which is logged
+// along with the job.
+func submitChatJob(uuid string, userId int, payload Payload, userTurn *Messages) error {
+	payloadJson, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	prompt := string(payloadJson)
+	if len(prompt) > 50 {
+		prompt = prompt[:50]
+	}
+
+	db, _ := getDb()
+	defer db.Close()
+	_, err = db.Exec("INSERT INTO async (uuid, prompt, answer, user_id, model, payload, status, queued_at) VALUES (?, ?, '', ?, ?, ?, ?, ?)", uuid, prompt, userId, payload.Model, string(payloadJson), JOB_QUEUED, now)
+	if err != nil {
+		return err
+	}
+	if payload.LogChat && userTurn != nil {
+		err = logChatTurn(db, userId, payload.ConversationId, uuid, payload.Model, *userTurn)
+		if err != nil {
+			fmt.Printf("Failed to log the prompt of job %s: %v", uuid, err)
+		}
+	}
+
+	// open the stream before queueing so /async/stream subscribers can't
+	// miss the first tokens
+	queue.enqueue(&chatJob{UUID: uuid, UserId: userId, Payload: payload, QueuedAt: now, stream: openStream(uuid)})
+	return nil
+}
+
+// recoverOrphanedJobs deals with the jobs that were running when the previous
+// process died. Depending on RECOVER_JOBS they are either put back into the
+// queue ("requeue", the default) or marked as failed ("fail"). Jobs without a
+// stored payload, or which already crashed the companion MAX_JOB_ATTEMPTS
+// times, are always marked as failed.
+func recoverOrphanedJobs() {
+	db, _ := getDb()
+	defer db.Close()
+
+	rows, err := db.Query("SELECT uuid, user_id, payload, attempts, queued_at FROM async WHERE status = ?", JOB_RUNNING)
+	if err != nil {
+		fmt.Printf("Failed to recover orphaned jobs: %v", err)
+		return
+	}
+	var requeue, fail []*chatJob
+	for rows.Next() {
+		var job chatJob
+		var payloadJson sql.NullString
+		var attempts int
+		var queuedAt sql.NullTime
+		err = rows.Scan(&job.UUID, &job.UserId, &payloadJson, &attempts, &queuedAt)
+		if err != nil {
+			fmt.Printf("Failed to read orphaned job: %v", err)
+			continue
+		}
+		job.QueuedAt = queuedAt.Time
+		if !payloadJson.Valid || json.Unmarshal([]byte(payloadJson.String), &job.Payload) != nil ||
+			attempts >= MAX_JOB_ATTEMPTS || os.Getenv("RECOVER_JOBS") == "fail" {
+			fail = append(fail, &job)
+		} else {
+			requeue = append(requeue, &job)
+		}
+	}
+	rows.Close()
+
+	requeuedCount, failedCount := 0, 0
+	for _, job := range requeue {
+		_, err = db.Exec("UPDATE async SET status = ?, started_at = NULL WHERE uuid = ? AND status = ?", JOB_QUEUED, job.UUID, JOB_RUNNING)
+		if err != nil {
+			fmt.Printf("Failed to re-queue job %s: %v", job.UUID, err)
+			continue
+		}
+		requeuedCount++
+	}
+	for _, job := range fail {
+		errMsg := "interrupted by a restart of the companion"
+		notify := jobCallback(job, JOB_FAILED, nil, errMsg)
+		failed, err := markJobFailed(job.UUID, errMsg)
+		if err != nil {
+			fmt.Printf("Failed to mark job %s as failed: %v", job.UUID, err)
+			continue
+		}
+		if failed {
+			notify()
+			failedCount++
+		}
+	}
+	fmt.Printf("Recovered orphaned jobs: %d re-queued, %d failed\n", requeuedCount, failedCount)
+}
+
+// loadQueuedJobs puts the jobs still waiting in the async table back into the
+// queue, so that a restart doesn't lose them
+func loadQueuedJobs() {
+	db, _ := getDb()
+	defer db.Close()
+
+	rows, err := db.Query("SELECT uuid, user_id, payload, queued_at FROM async WHERE status = ? AND payload IS NOT NULL ORDER BY queued_at", JOB_QUEUED)
+	if err != nil {
+		fmt.Printf("Failed to load queued jobs: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var job chatJob
+		var payloadJson string
+		err = rows.Scan(&job.UUID, &job.UserId, &payloadJson, &job.QueuedAt)
+		if err != nil {
+			fmt.Printf("Failed to read queued job: %v", err)
+			continue
+		}
+		err = json.Unmarshal([]byte(payloadJson), &job.Payload)
+		if err != nil {
+			// without a payload there is no callback_url to report to either
+			fmt.Printf("Failed to unmarshal payload of job %s: %v", job.UUID, err)
+			markJobFailed(job.UUID, "Failed to read the stored request")
+			continue
+		}
+		job.stream = openStream(job.UUID)
+		queue.enqueue(&job)
+		count++
+	}
+	fmt.Printf("Re-queued %d waiting job(s)\n", count)
+}
+
+// listUserJobs returns the pending jobs of a user along with their position
+// in the queue of their model. The ETA simulates the model's workers going
+// through the running and waiting jobs, each taking the average answer time.
+func listUserJobs(db *sql.DB, userId int) []QueuedJobInfo {
+	jobs := []QueuedJobInfo{}
+	for _, model := range queue.models(userId) {
+		estimate, err := estimateModel(db, model)
+		if err != nil {
+			fmt.Printf("Failed to estimate %s: %v", model, err)
+		}
+		hasHistory := estimate.Samples > 0
+		running, pending := queue.snapshot(model)
+
+		// time at which each worker becomes available
+		slots := make([]float64, workerCount(model))
+		for i, job := range running {
+			tokens := job.stream.tokenCount()
+			remaining := estimate.remaining(tokens, time.Since(job.StartedAt))
+			if i < len(slots) {
+				slots[i] = remaining
+			}
+			if job.UserId != userId {
+				continue
+			}
+			info := QueuedJobInfo{UniqueID: job.UUID, Model: model, State: JOB_RUNNING, QueuedAt: job.QueuedAt, Tokens: tokens}
+			startedAt := job.StartedAt
+			info.StartedAt = &startedAt
+			if hasHistory {
+				info.EtaSeconds = &remaining
+			}
+			jobs = append(jobs, info)
+		}
+
+		for position, job := range pending {
+			slot := 0
+			for i := range slots {
+				if slots[i] < slots[slot] {
+					slot = i
+				}
+			}
+			slots[slot] += estimate.AvgAnswerDuration
+			if job.UserId != userId {
+				continue
+			}
+			info := QueuedJobInfo{UniqueID: job.UUID, Model: model, State: JOB_QUEUED, Position: position + 1, QueuedAt: job.QueuedAt}
+			if hasHistory {
+				eta := slots[slot]
+				info.EtaSeconds = &eta
+			}
+			jobs = append(jobs, info)
+		}
+	}
+	return jobs
+}
+
+// Handler for the /async/queue endpoint
+func queueHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := getUserId(w, r)
+	if err != nil {
+		return
+	}
+
+	db, _ := getDb()
+	defer db.Close()
+
+	jsonRes, err := json.Marshal(listUserJobs(db, userId))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonRes)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// QuotaStatus is returned by /async/quota. Limits of 0 mean unlimited.
+type QuotaStatus struct {
+	RequestsPerMinute int       `json:"requests_per_minute"`
+	RequestsRemaining int       `json:"requests_remaining"`
+	DailyTokenQuota   int64     `json:"daily_token_quota"`
+	TokensUsedToday   int64     `json:"tokens_used_today"`
+	TokensRemaining   int64     `json:"tokens_remaining"`
+	ResetsAt          time.Time `json:"resets_at"`
+}
+
+// timestamps of the requests of the last minute, by user
+var requestLog = struct {
+	sync.Mutex
+	m map[int][]time.Time
+}{m: make(map[int][]time.Time)}
+
+// userLimits returns the limits of a user: the users table overrides the
+// RATE_LIMIT_PER_MINUTE and DAILY_TOKEN_QUOTA environment variables.
+func userLimits(db *sql.DB, userId int) (int, int64, error) {
+	rpm, _ := strconv.Atoi(os.Getenv("RATE_LIMIT_PER_MINUTE"))
+	quota, _ := strconv.ParseInt(os.Getenv("DAILY_TOKEN_QUOTA"), 10, 64)
+
+	var userRpm, userQuota sql.NullInt64
+	err := db.QueryRow("SELECT requests_per_minute, daily_token_quota FROM users WHERE id = ?", userId).Scan(&userRpm, &userQuota)
+	if err != nil {
+		return rpm, quota, err
+	}
+	if userRpm.Valid {
+		rpm = int(userRpm.Int64)
+	}
+	if userQuota.Valid {
+		quota = userQuota.Int64
+	}
+	return rpm, quota, nil
+}
+
+// tokensUsedToday sums prompt and answer tokens of the user since midnight
+func tokensUsedToday(db *sql.DB, userId int) (int64, error) {
+	var used sql.NullInt64
+	err := db.QueryRow("SELECT SUM(prompt_eval_count + eval_count) FROM llm_stats WHERE user_id = ? AND datetime >= ?", userId, startOfDay()).Scan(&used)
+	return used.Int64, err
+}
+
+func startOfDay() time.Time {
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+}
+
+// recentRequests prunes and returns the user's requests of the last minute
+// must be called with requestLog held
+func recentRequests(userId int) []time.Time {
+	limit := time.Now().Add(-time.Minute)
+	recent := requestLog.m[userId][:0]
+	for _, t := range requestLog.m[userId] {
+		if t.After(limit) {
+			recent = append(recent, t)
+		}
+	}
+	requestLog.m[userId] = recent
+	return recent
+}
+
+// limitExceeded tells why a request is refused and when to retry
+type limitExceeded struct {
+	Message    string
+	RetryAfter time.Duration
+}
+
+// retryAfterHeader is the Retry-After value, in whole seconds rounded up
+func (l *limitExceeded) retryAfterHeader() string {
+	return strconv.Itoa(int(l.RetryAfter.Seconds()) + 1)
+}
+
+// checkLimits counts a request of the user, returns nil if it is within the
+// user's limits. checkTokens also enforces the daily token quota, for
+// requests generating tokens.
+func checkLimits(userId int, checkTokens bool) *limitExceeded {
+	db, _ := getDb()
+	defer db.Close()
+
+	rpm, quota, err := userLimits(db, userId)
+	if err != nil {
+		fmt.Printf("Failed to read limits of user %d: %v", userId, err)
+	}
+
+	if checkTokens && quota > 0 {
+		used, err := tokensUsedToday(db, userId)
+		if err != nil {
+			fmt.Printf("Failed to read token usage of user %d: %v", userId, err)
+		}
+		if used >= quota {
+			return &limitExceeded{Message: "Daily token quota exceeded", RetryAfter: time.Until(startOfDay().AddDate(0, 0, 1))}
+		}
+	}
+
+	if rpm > 0 {
+		requestLog.Lock()
+		defer requestLog.Unlock()
+		recent := recentRequests(userId)
+		if len(recent) >= rpm {
+			return &limitExceeded{Message: "Too many requests", RetryAfter: time.Until(recent[0].Add(time.Minute))}
+		}
+		requestLog.m[userId] = append(recent, time.Now())
+	}
+	return nil
+}
+
+// enforceLimits answers 429 with a Retry-After header if the request exceeds
+// the user's limits. Returns false if the request must not be processed.
+func enforceLimits(w http.ResponseWriter, userId int, checkTokens bool) bool {
+	exceeded := checkLimits(userId, checkTokens)
+	if exceeded == nil {
+		return true
+	}
+	w.Header().Set("Retry-After", exceeded.retryAfterHeader())
+	http.Error(w, exceeded.Message, http.StatusTooManyRequests)
+	return false
+}
+
+// Handler for the /async/quota endpoint
+func quotaHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := getUserId(w, r)
+	if err != nil {
+		return
+	}
+
+	db, _ := getDb()
+	defer db.Close()
+
+	var status QuotaStatus
+	status.RequestsPerMinute, status.DailyTokenQuota, err = userLimits(db, userId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	status.TokensUsedToday, err = tokensUsedToday(db, userId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if status.RequestsPerMinute > 0 {
+		requestLog.Lock()
+		status.RequestsRemaining = max(status.RequestsPerMinute-len(recentRequests(userId)), 0)
+		requestLog.Unlock()
+	}
+	if status.DailyTokenQuota > 0 {
+		status.TokensRemaining = max(status.DailyTokenQuota-status.TokensUsedToday, 0)
+	}
+	status.ResetsAt = startOfDay().AddDate(0, 0, 1)
+
+	jsonRes, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonRes)
+}
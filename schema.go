@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ///////////////////////////////////////////////////////////
+// Schema upgrades, applied on startup so that ./restart.sh
+// keeps existing installations up to date
+// ///////////////////////////////////////////////////////////
+
+// tables added after the initial ollamaui schema
+var schemaTables = []string{
+	`CREATE TABLE IF NOT EXISTS llm_stats (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id INT NOT NULL,
+		model VARCHAR(255) NOT NULL,
+		prompt_eval_count BIGINT NOT NULL DEFAULT 0,
+		prompt_eval_duration BIGINT NOT NULL DEFAULT 0,
+		eval_count BIGINT NOT NULL DEFAULT 0,
+		eval_duration BIGINT NOT NULL DEFAULT 0,
+		load_duration BIGINT NOT NULL DEFAULT 0,
+		total_duration BIGINT NOT NULL DEFAULT 0,
+		datetime DATETIME NOT NULL,
+		INDEX (model),
+		INDEX (user_id, datetime)
+	)`,
+	`CREATE TABLE IF NOT EXISTS pinned_models (
+		model VARCHAR(255) PRIMARY KEY,
+		pinned_at DATETIME NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS model_history (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id INT NOT NULL,
+		action VARCHAR(16) NOT NULL,
+		model VARCHAR(255) NOT NULL,
+		host VARCHAR(255) NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		error TEXT NULL,
+		started_at DATETIME NOT NULL,
+		finished_at DATETIME NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS personas (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id INT NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		system_prompt TEXT NOT NULL,
+		model VARCHAR(255) NOT NULL DEFAULT '',
+		temperature DOUBLE NOT NULL DEFAULT 0,
+		keep_alive VARCHAR(32) NULL,
+		avatar MEDIUMTEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		INDEX (user_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS conversations (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id INT NOT NULL,
+		title VARCHAR(255) NOT NULL DEFAULT '',
+		archived TINYINT(1) NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		INDEX (user_id, updated_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS conversation_summaries (
+		user_id INT NOT NULL,
+		conversation_id INT NOT NULL,
+		content TEXT NOT NULL,
+		last_chat_log_id INT NOT NULL,
+		updated_at DATETIME NOT NULL,
+		PRIMARY KEY (user_id, conversation_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS job_steps (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		job_uuid VARCHAR(36) NOT NULL,
+		step INT NOT NULL,
+		round INT NOT NULL,
+		tool VARCHAR(64) NOT NULL,
+		arguments TEXT NOT NULL,
+		result MEDIUMTEXT NOT NULL,
+		error TEXT NULL,
+		started_at DATETIME(6) NOT NULL,
+		finished_at DATETIME(6) NOT NULL,
+		INDEX (job_uuid)
+	)`,
+}
+
+// columns added to existing tables, as table, column and column definition
+var schemaColumns = [][3]string{
+	{"async", "user_id", "INT NOT NULL DEFAULT 0"},
+	{"async", "model", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"async", "payload", "LONGTEXT NULL"},
+	{"async", "status", "VARCHAR(16) NOT NULL DEFAULT ''"},
+	{"async", "queued_at", "DATETIME(6) NULL"},
+	{"async", "started_at", "DATETIME(6) NULL"},
+	{"async", "finished_at", "DATETIME(6) NULL"},
+	{"async", "error", "TEXT NULL"},
+	{"async", "attempts", "INT NOT NULL DEFAULT 0"},
+	{"users", "requests_per_minute", "INT NULL"},
+	{"users", "daily_token_quota", "BIGINT NULL"},
+	{"users", "is_admin", "TINYINT(1) NOT NULL DEFAULT 0"},
+	{"personas", "options", "TEXT NULL"},
+	{"chat_log", "images", "LONGTEXT NULL"},
+	{"chat_log", "job_uuid", "VARCHAR(36) NULL"},
+	{"chat_log", "model", "VARCHAR(255) NULL"},
+	{"chat_log", "conversation_id", "INT NULL"},
+	{"memories", "conversation_id", "INT NULL"},
+}
+
+// columns whose type changed, as table, column, new column type, and the
+// data fix run right after the column has been changed
+var schemaChanges = [][4]string{
+	// keep_alive became seconds or a duration, NULL when unset rather than 0
+	{"personas", "keep_alive", "VARCHAR(32) NULL", "UPDATE personas SET keep_alive = NULL WHERE keep_alive = '0'"},
+}
+
+// data fixes run after the columns are in place, they must be idempotent
+var schemaData = []string{
+	// rows written before the status column existed
+	"UPDATE async SET status = 'done' WHERE status = '' AND answer LIKE '{%'",
+	"UPDATE async SET status = 'cancelled' WHERE status = '' AND answer = 'cancelled'",
+	"UPDATE async SET status = 'running' WHERE status = ''",
+}
+
+func migrateDb() {
+	db, _ := getDb()
+	defer db.Close()
+
+	for _, statement := range schemaTables {
+		_, err := db.Exec(statement)
+		if err != nil {
+			log.Fatalf("Error creating table: %v", err)
+		}
+	}
+	for _, column := range schemaColumns {
+		err := addColumn(db, column[0], column[1], column[2])
+		if err != nil {
+			log.Fatalf("Error adding column %s.%s: %v", column[0], column[1], err)
+		}
+	}
+	for _, change := range schemaChanges {
+		err := changeColumn(db, change[0], change[1], change[2], change[3])
+		if err != nil {
+			log.Fatalf("Error changing column %s.%s: %v", change[0], change[1], err)
+		}
+	}
+	for _, statement := range schemaData {
+		_, err := db.Exec(statement)
+		if err != nil {
+			log.Fatalf("Error updating data: %v", err)
+		}
+	}
+}
+
+// addColumn adds a column unless it already exists. information_schema is
+// used instead of ADD COLUMN IF NOT EXISTS, which MySQL doesn't understand.
+func addColumn(db *sql.DB, table string, column string, definition string) error {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?", table, column).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	fmt.Printf("Adding column %s.%s\n", table, column)
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// changeColumn changes the type of a column, unless it already has it, and
+// runs the data fix going along with the change
+func changeColumn(db *sql.DB, table string, column string, definition string, fix string) error {
+	var columnType string
+	err := db.QueryRow("SELECT COLUMN_TYPE FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?", table, column).Scan(&columnType)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(strings.ToUpper(definition), strings.ToUpper(columnType)+" ") {
+		return nil
+	}
+	fmt.Printf("Changing column %s.%s to %s\n", table, column, definition)
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(fix)
+	return err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// amount of recent answers per model the estimates are based on
+const STATS_WINDOW = 50
+
+// ModelEstimate summarizes the recent answers of a model
+type ModelEstimate struct {
+	Samples           int     `json:"samples"`
+	AvgEvalCount      float64 `json:"avg_eval_count"`
+	TokensPerSecond   float64 `json:"tokens_per_second"`
+	AvgPromptDuration float64 `json:"avg_prompt_seconds"`
+	AvgAnswerDuration float64 `json:"avg_answer_seconds"`
+}
+
+// recordStats keeps the figures of a finished answer for later estimates
+func recordStats(userId int, answer LLMAnswer) {
+	db, _ := getDb()
+	defer db.Close()
+	_, err := db.Exec("INSERT INTO llm_stats (user_id, model, prompt_eval_count, prompt_eval_duration, eval_count, eval_duration, load_duration, total_duration, datetime) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		userId, answer.Model, answer.PromptEvalCount, answer.PromptEvalDuration, answer.EvalCount, answer.EvalDuration, answer.LoadDuration, answer.TotalDuration, time.Now())
+	if err != nil {
+		fmt.Printf("Failed to record answer stats: %v", err)
+	}
+}
+
+// addUsage adds the figures of an earlier round of the same job, so that a
+// job is accounted for with every token it put through the model
+func (a *LLMAnswer) addUsage(earlier LLMAnswer) {
+	if a.Model == "" {
+		a.Model = earlier.Model
+	}
+	a.PromptEvalCount += earlier.PromptEvalCount
+	a.PromptEvalDuration += earlier.PromptEvalDuration
+	a.EvalCount += earlier.EvalCount
+	a.EvalDuration += earlier.EvalDuration
+	a.LoadDuration += earlier.LoadDuration
+	a.TotalDuration += earlier.TotalDuration
+}
+
+// estimateModel computes the generation speed of a model from its last
+// STATS_WINDOW answers. Samples is 0 if the model has no history yet.
+func estimateModel(db *sql.DB, model string) (ModelEstimate, error) {
+	var estimate ModelEstimate
+	var avgEvalCount, sumEvalCount, sumEvalDuration, avgPromptDuration sql.NullFloat64
+	err := db.QueryRow("SELECT COUNT(*), AVG(eval_count), SUM(eval_count), SUM(eval_duration), AVG(prompt_eval_duration + load_duration) FROM (SELECT eval_count, eval_duration, prompt_eval_duration, load_duration FROM llm_stats WHERE model = ? ORDER BY id DESC LIMIT ?) AS recent", model, STATS_WINDOW).
+		Scan(&estimate.Samples, &avgEvalCount, &sumEvalCount, &sumEvalDuration, &avgPromptDuration)
+	if err != nil || estimate.Samples == 0 || sumEvalDuration.Float64 <= 0 {
+		estimate.Samples = 0
+		return estimate, err
+	}
+	estimate.AvgEvalCount = avgEvalCount.Float64
+	// durations are reported by Ollama in nanoseconds
+	estimate.TokensPerSecond = sumEvalCount.Float64 / (sumEvalDuration.Float64 / 1e9)
+	estimate.AvgPromptDuration = avgPromptDuration.Float64 / 1e9
+	estimate.AvgAnswerDuration = estimate.AvgPromptDuration + estimate.AvgEvalCount/estimate.TokensPerSecond
+	return estimate, nil
+}
+
+// remaining estimates the seconds a running job still needs, given the
+// amount of tokens it produced so far
+func (e ModelEstimate) remaining(tokens int, elapsed time.Duration) float64 {
+	if e.Samples == 0 {
+		return 0
+	}
+	if tokens == 0 {
+		return max(e.AvgAnswerDuration-elapsed.Seconds(), 0)
+	}
+	return max((e.AvgEvalCount-float64(tokens))/e.TokensPerSecond, 0)
+}
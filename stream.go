@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// how long a finished stream stays in memory for late subscribers before
+// they have to fall back to the async table
+const STREAM_LINGER = 1 * time.Minute
+
+// interval of the SSE comment lines keeping proxies from closing idle streams
+const STREAM_KEEPALIVE = 15 * time.Second
+
+// chatChunk is a single NDJSON line of a streamed /api/chat answer
+type chatChunk struct {
+	LLMAnswer
+	Error string `json:"error"`
+}
+
+type StreamToken struct {
+	Content string `json:"content"`
+}
+
+type StreamError struct {
+	Error string `json:"error"`
+}
+
+// chatStream holds the tokens produced so far for a single job, so that
+// subscribers joining late can catch up before receiving live tokens.
+type chatStream struct {
+	mu        sync.Mutex
+	tokens    []string
+	resets    int
+	done      bool
+	final     *LLMAnswer
+	errMsg    string
+	listeners map[chan struct{}]struct{}
+}
+
+var streams = struct {
+	sync.Mutex
+	m map[string]*chatStream
+}{m: make(map[string]*chatStream)}
+
+func openStream(uuid string) *chatStream {
+	streams.Lock()
+	defer streams.Unlock()
+	s, ok := streams.m[uuid]
+	if !ok {
+		s = &chatStream{listeners: make(map[chan struct{}]struct{})}
+		streams.m[uuid] = s
+	}
+	return s
+}
+
+func getStream(uuid string) *chatStream {
+	streams.Lock()
+	defer streams.Unlock()
+	return streams.m[uuid]
+}
+
+func (s *chatStream) publish(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = append(s.tokens, token)
+	s.wake()
+}
+
+// reset drops the tokens published so far, when a job starts over on
+// another backend
+func (s *chatStream) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = nil
+	s.resets++
+	s.wake()
+}
+
+// finish marks the stream as complete, either with the final answer or with
+// an error message, and schedules its removal.
+func (s *chatStream) finish(uuid string, answer *LLMAnswer, errMsg string) {
+	s.mu.Lock()
+	s.done = true
+	s.final = answer
+	s.errMsg = errMsg
+	s.wake()
+	s.mu.Unlock()
+
+	time.AfterFunc(STREAM_LINGER, func() {
+		streams.Lock()
+		defer streams.Unlock()
+		if streams.m[uuid] == s {
+			delete(streams.m, uuid)
+		}
+	})
+}
+
+// wake notifies every listener without blocking; must be called with s.mu held
+func (s *chatStream) wake() {
+	for ch := range s.listeners {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *chatStream) subscribe() chan struct{} {
+	ch := make(chan struct{}, 1)
+	s.mu.Lock()
+	s.listeners[ch] = struct{}{}
+	s.mu.Unlock()
+	return ch
+}
+
+func (s *chatStream) unsubscribe(ch chan struct{}) {
+	s.mu.Lock()
+	delete(s.listeners, ch)
+	s.mu.Unlock()
+}
+
+func (s *chatStream) tokenCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.tokens)
+}
+
+type streamSnapshot struct {
+	Tokens []string
+	Resets int
+	Done   bool
+	Final  *LLMAnswer
+	ErrMsg string
+}
+
+// since returns the tokens published after the first `from` ones, along with
+// the completion state of the stream. If the stream has been reset since the
+// caller saw `resets` resets, all the tokens are returned.
+func (s *chatStream) since(from int, resets int) streamSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if resets != s.resets {
+		from = 0
+	}
+	tokens := append([]string(nil), s.tokens[from:]...)
+	return streamSnapshot{Tokens: tokens, Resets: s.resets, Done: s.done, Final: s.final, ErrMsg: s.errMsg}
+}
+
+// readChatStream consumes the NDJSON answer of /api/chat, publishing every
+// token to the job's stream, and returns the assembled answer in the same
+// shape Ollama uses for non-streamed replies.
+func readChatStream(s *chatStream, body io.Reader) (LLMAnswer, error) {
+	var answer LLMAnswer
+	var content []byte
+	var toolCalls []ToolCall
+	reader := bufio.NewReader(body)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var chunk chatChunk
+			if jsonErr := json.Unmarshal(line, &chunk); jsonErr != nil {
+				return answer, fmt.Errorf("failed to unmarshal stream chunk: %v", jsonErr)
+			}
+			if chunk.Error != "" {
+				return answer, &backendStatusError{StatusCode: http.StatusInternalServerError, Body: chunk.Error}
+			}
+			if chunk.Message.Content != "" {
+				content = append(content, chunk.Message.Content...)
+				s.publish(chunk.Message.Content)
+			}
+			toolCalls = append(toolCalls, chunk.Message.ToolCalls...)
+			if chunk.Done {
+				answer = chunk.LLMAnswer
+				answer.Message.Role = "assistant"
+				answer.Message.Content = string(content)
+				answer.Message.ToolCalls = toolCalls
+				return answer, nil
+			}
+		}
+		if err == io.EOF {
+			return answer, errors.New("stream ended before the answer was done")
+		}
+		if err != nil {
+			return answer, err
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event string, data interface{}) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		fmt.Printf("Failed to marshal stream event: %v", err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, jsonData)
+}
+
+// Handler for the /async/stream endpoint, relaying a job's tokens as
+// Server-Sent Events. Emits "token" events, followed by either a "done"
+// event carrying the full LLMAnswer or an "error" event. A "reset" event
+// means the tokens received so far must be discarded.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	uid := r.URL.Query().Get("uid")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	s := getStream(uid)
+	if s == nil {
+		// the job is not running in this process (anymore), the async table
+		// is the only place left to look at
+		db, _ := getDb()
+		defer db.Close()
+		status, err := loadJobStatus(db, uid)
+		if err == sql.ErrNoRows {
+			writeEvent(w, "error", StreamError{Error: "not found"})
+		} else if err != nil {
+			writeEvent(w, "error", StreamError{Error: "Internal Server Error"})
+		} else if status.State == JOB_DONE {
+			writeEvent(w, "done", status.LLMAnswer)
+		} else if status.State == JOB_FAILED {
+			writeEvent(w, "error", StreamError{Error: status.Error})
+		} else if status.State == JOB_CANCELLED {
+			writeEvent(w, "error", StreamError{Error: JOB_CANCELLED})
+		} else {
+			writeEvent(w, "error", StreamError{Error: "no stream available for this job"})
+		}
+		flusher.Flush()
+		return
+	}
+
+	ch := s.subscribe()
+	defer s.unsubscribe(ch)
+	ticker := time.NewTicker(STREAM_KEEPALIVE)
+	defer ticker.Stop()
+
+	sent, resets := 0, 0
+	for {
+		snapshot := s.since(sent, resets)
+		if snapshot.Resets != resets {
+			// the job started over on another backend, drop what was sent
+			writeEvent(w, "reset", struct{}{})
+			sent, resets = 0, snapshot.Resets
+		}
+		for _, token := range snapshot.Tokens {
+			writeEvent(w, "token", StreamToken{Content: token})
+		}
+		sent += len(snapshot.Tokens)
+		if snapshot.Done {
+			if snapshot.ErrMsg != "" {
+				writeEvent(w, "error", StreamError{Error: snapshot.ErrMsg})
+			} else {
+				writeEvent(w, "done", snapshot.Final)
+			}
+		}
+		flusher.Flush()
+		if snapshot.Done {
+			return
+		}
+
+		select {
+		case <-ch:
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// rollingSummary is the summary of the beginning of a conversation, up to
+// and including the chat_log row LastId, which stands in for those turns in
+// assembled prompts
+type rollingSummary struct {
+	Content string
+	LastId  int
+}
+
+func (s rollingSummary) message() Messages {
+	return Messages{Role: "system", Content: "Summary of the conversation so far:\n" + s.Content, Persona: "Memory", IsMemory: true}
+}
+
+func (s rollingSummary) tokens() int {
+	if s.Content == "" {
+		return 0
+	}
+	return estimateTokens(s.message().Content)
+}
+
+// conversation 0 is stored as 0 rather than NULL, being part of the key
+func loadRollingSummary(db *sql.DB, userId int, conversationId int) (rollingSummary, error) {
+	var summary rollingSummary
+	err := db.QueryRow("SELECT content, last_chat_log_id FROM conversation_summaries WHERE user_id = ? AND conversation_id = ?", userId, conversationId).Scan(&summary.Content, &summary.LastId)
+	if err == sql.ErrNoRows {
+		return summary, nil
+	}
+	return summary, err
+}
+
+// storeRollingSummary replaces the summary reaching up to previousId, and
+// returns false if a concurrent roll replaced it in the meantime
+func storeRollingSummary(db *sql.DB, userId int, conversationId int, previousId int, summary rollingSummary) (bool, error) {
+	var result sql.Result
+	var err error
+	if previousId == 0 {
+		result, err = db.Exec("INSERT IGNORE INTO conversation_summaries (user_id, conversation_id, content, last_chat_log_id, updated_at) VALUES (?, ?, ?, ?, ?)",
+			userId, conversationId, summary.Content, summary.LastId, time.Now())
+	} else {
+		result, err = db.Exec("UPDATE conversation_summaries SET content = ?, last_chat_log_id = ?, updated_at = ? WHERE user_id = ? AND conversation_id = ? AND last_chat_log_id = ?",
+			summary.Content, summary.LastId, time.Now(), userId, conversationId, previousId)
+	}
+	if err != nil {
+		return false, err
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+// a roll of each conversation at a time, so that concurrent requests don't
+// summarize the same turns
+var rollLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: make(map[string]*sync.Mutex)}
+
+func lockRoll(userId int, conversationId int) func() {
+	key := fmt.Sprintf("%d/%d", userId, conversationId)
+	rollLocks.Lock()
+	lock, ok := rollLocks.m[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		rollLocks.m[key] = lock
+	}
+	rollLocks.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+// rollConversation folds the oldest turns of a conversation into its summary,
+// at least the first `first` ones and as many as needed for the rest to fit
+// into half of budget tokens, so that the next turns fit without summarizing
+// again. It returns the summary and the turns after it. Should another
+// process have rolled the conversation meanwhile, its summary is used.
+func rollConversation(db *sql.DB, userId int, conversationId int, first int, budget int) (rollingSummary, []Messages, error) {
+	unlock := lockRoll(userId, conversationId)
+	defer unlock()
+
+	// a concurrent request may have rolled while we waited for the lock
+	summary, err := loadRollingSummary(db, userId, conversationId)
+	if err != nil {
+		return summary, nil, err
+	}
+	turns, err := turnsAfter(db, userId, conversationId, summary.LastId)
+	if err != nil {
+		return summary, nil, err
+	}
+	if fitTurns(turns, budget-summary.tokens()) == 0 {
+		return summary, turns, nil
+	}
+
+	cut := min(max(fitTurns(turns, (budget-summary.tokens())/2), first), len(turns))
+	rolled, err := rollSummary(summary, turns[:cut])
+	if err != nil {
+		return summary, nil, err
+	}
+	stored, err := storeRollingSummary(db, userId, conversationId, summary.LastId, rolled)
+	if err != nil {
+		return summary, nil, err
+	}
+	if !stored {
+		summary, err = loadRollingSummary(db, userId, conversationId)
+		if err != nil {
+			return summary, nil, err
+		}
+		turns, err = turnsAfter(db, userId, conversationId, summary.LastId)
+		return summary, turns, err
+	}
+	return rolled, turns[cut:], nil
+}
+
+// rollSummary folds turns into the summary with the SUMMARIZER model. Turns
+// are sent in chunks of at most DEFAULT_NUM_CTX / 2 tokens, each one
+// summarized along with the summary so far.
+func rollSummary(summary rollingSummary, turns []Messages) (rollingSummary, error) {
+	for len(turns) > 0 {
+		chunk := ""
+		count := 0
+		for count < len(turns) {
+			turn := turns[count]
+			speaker := "The user"
+			if turn.Role == "assistant" {
+				speaker = turn.Persona
+				if speaker == "" {
+					speaker = "The assistant"
+				}
+			}
+			line := fmt.Sprintf("%s said '\n%s\n'\n\n", speaker, turn.Content)
+			if count > 0 && estimateTokens(chunk+line) > DEFAULT_NUM_CTX/2 {
+				break
+			}
+			chunk += line
+			count++
+		}
+
+		prompt := chunk + "\nWrite a short summary of the discussion written above, keeping names, facts and decisions."
+		if summary.Content != "" {
+			prompt = "This is a summary of the beginning of a discussion:\n" + summary.Content + "\n\nThis is how it went on:\n" + chunk +
+				"\nWrite a short summary of the whole discussion, keeping names, facts and decisions."
+		}
+		body, err := json.Marshal(LLMRequest{Model: os.Getenv("SUMMARIZER"), Prompt: prompt})
+		if err != nil {
+			return summary, err
+		}
+		content, err := callGenerateOnSummarizer(body)
+		if err != nil {
+			return summary, err
+		}
+
+		summary = rollingSummary{Content: content, LastId: turns[count-1].Id}
+		turns = turns[count:]
+	}
+	return summary, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// amount of tool call rounds before a job gives up on getting an answer
+const MAX_TOOL_ROUNDS = 8
+
+// tool results are cut to this many characters, fetched pages get long
+const MAX_TOOL_RESULT = 20000
+
+type ToolCall struct {
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name      string                 `json:"name"`
+	Arguments map[string]interface{} `json:"arguments"`
+}
+
+// toolDefinition is a tool as offered in the "tools" of /api/chat
+type toolDefinition struct {
+	Type     string       `json:"type"`
+	Function toolFunction `json:"function"`
+}
+
+type toolFunction struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Parameters  map[string]interface{} `json:"parameters"`
+}
+
+// JobStep is a tool call made while answering a job, as listed in the
+// status of the job
+type JobStep struct {
+	Step       int                    `json:"step"`
+	Round      int                    `json:"round"`
+	Tool       string                 `json:"tool"`
+	Arguments  map[string]interface{} `json:"arguments"`
+	Result     string                 `json:"result"`
+	Error      string                 `json:"error,omitempty"`
+	StartedAt  time.Time              `json:"started_at"`
+	FinishedAt time.Time              `json:"finished_at"`
+}
+
+func stringParameter(name string, description string) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			name: map[string]interface{}{"type": "string", "description": description},
+		},
+		"required": []string{name},
+	}
+}
+
+var chatTools = []toolDefinition{
+	{Type: "function", Function: toolFunction{
+		Name:        "web_search",
+		Description: "Search the web. Returns titles, URLs and snippets of the best hits.",
+		Parameters:  stringParameter("query", "what to search for"),
+	}},
+	{Type: "function", Function: toolFunction{
+		Name:        "fetch_url",
+		Description: "Fetch a web page. Returns its text and links.",
+		Parameters:  stringParameter("url", "absolute http(s) URL of the page"),
+	}},
+}
+
+// publicIP tells whether an address is reachable from the internet, rather
+// than only from the companion's own host or network
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// validFetchURL only accepts absolute http(s) URLs of hosts with public
+// addresses, so the model can't be steered into fetching internal hosts
+func validFetchURL(ctx context.Context, fetchUrl string) bool {
+	if !validCallbackURL(fetchUrl) {
+		return false
+	}
+	parsed, _ := url.Parse(fetchUrl)
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, parsed.Hostname())
+	if err != nil || len(addresses) == 0 {
+		return false
+	}
+	for _, address := range addresses {
+		if !publicIP(address.IP) {
+			return false
+		}
+	}
+	return true
+}
+
+// toolHttpClient fetches pages for the model. Addresses are checked again on
+// connect, as redirects and later DNS answers may point elsewhere.
+var toolHttpClient = &http.Client{
+	Timeout: FETCH_TIMEOUT,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: func(network string, address string, conn syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+					return fmt.Errorf("refusing to connect to %s", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// runTool performs a tool call of the model and returns what is handed
+// back to it
+func runTool(ctx context.Context, call ToolCall) (string, error) {
+	argument := func(name string) (string, error) {
+		value, ok := call.Function.Arguments[name].(string)
+		if !ok || value == "" {
+			return "", fmt.Errorf("%s needs a %s", call.Function.Name, name)
+		}
+		return value, nil
+	}
+
+	switch call.Function.Name {
+	case "web_search":
+		query, err := argument("query")
+		if err != nil {
+			return "", err
+		}
+		result, err := searxSearch(ctx, query)
+		if err != nil {
+			return "", err
+		}
+		encoded, err := json.Marshal(result)
+		return string(encoded), err
+	case "fetch_url":
+		fetchUrl, err := argument("url")
+		if err != nil {
+			return "", err
+		}
+		if !validFetchURL(ctx, fetchUrl) {
+			return "", errors.New("only absolute http(s) URLs of public hosts can be fetched")
+		}
+		page := fetchPage(ctx, toolHttpClient, fetchUrl)
+		if page.ReturnCode != http.StatusOK {
+			return "", errors.New(page.Content)
+		}
+		return page.Content, nil
+	}
+	return "", fmt.Errorf("unknown tool %s", call.Function.Name)
+}
+
+// chatWithTools asks the model until it answers without calling tools. The
+// calls are run, recorded as steps of the job and their results appended to
+// the messages. The counts of the answer cover all the rounds.
+func chatWithTools(ctx context.Context, uuid string, stream *chatStream, payload *Payload) (LLMAnswer, error) {
+	step := 0
+	var spent LLMAnswer
+	for round := 1; ; round++ {
+		answer, err := chatWithFailover(ctx, stream, *payload)
+		answer.addUsage(spent)
+		spent = answer
+		if err != nil || !payload.UseTools || len(answer.Message.ToolCalls) == 0 {
+			return answer, err
+		}
+		if round >= MAX_TOOL_ROUNDS {
+			return answer, fmt.Errorf("no answer after %d rounds of tool calls", round)
+		}
+
+		payload.Messages = append(payload.Messages, Messages{Role: "assistant", Content: answer.Message.Content, ToolCalls: answer.Message.ToolCalls})
+		for _, call := range answer.Message.ToolCalls {
+			step++
+			started := time.Now()
+			result, toolErr := runTool(ctx, call)
+			if ctx.Err() != nil {
+				return answer, ctx.Err()
+			}
+			if len(result) > MAX_TOOL_RESULT {
+				result = strings.ToValidUTF8(result[:MAX_TOOL_RESULT], "")
+			}
+			jobStep := JobStep{Step: step, Round: round, Tool: call.Function.Name, Arguments: call.Function.Arguments, Result: result, StartedAt: started, FinishedAt: time.Now()}
+			content := result
+			if toolErr != nil {
+				jobStep.Error = toolErr.Error()
+				content = "Error: " + toolErr.Error()
+			}
+			recordJobStep(uuid, jobStep)
+			payload.Messages = append(payload.Messages, Messages{Role: "tool", Content: content, ToolName: call.Function.Name})
+		}
+		// what was streamed so far led to the tool calls, not the answer
+		stream.reset()
+	}
+}
+
+func recordJobStep(uuid string, step JobStep) {
+	arguments, _ := json.Marshal(step.Arguments)
+	db, _ := getDb()
+	defer db.Close()
+	_, err := db.Exec("INSERT INTO job_steps (job_uuid, step, round, tool, arguments, result, error, started_at, finished_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		uuid, step.Step, step.Round, step.Tool, string(arguments), step.Result, sql.NullString{String: step.Error, Valid: step.Error != ""}, step.StartedAt, step.FinishedAt)
+	if err != nil {
+		fmt.Printf("Failed to record step %d of job %s: %v", step.Step, uuid, err)
+	}
+}
+
+// clearJobSteps forgets the steps of an earlier run of a job
+func clearJobSteps(db *sql.DB, uuid string) error {
+	_, err := db.Exec("DELETE FROM job_steps WHERE job_uuid = ?", uuid)
+	return err
+}
+
+func loadJobSteps(db *sql.DB, uuid string) ([]JobStep, error) {
+	rows, err := db.Query("SELECT step, round, tool, arguments, result, error, started_at, finished_at FROM job_steps WHERE job_uuid = ? ORDER BY step", uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var steps []JobStep
+	for rows.Next() {
+		var step JobStep
+		var arguments string
+		var stepErr sql.NullString
+		err = rows.Scan(&step.Step, &step.Round, &step.Tool, &arguments, &step.Result, &stepErr, &step.StartedAt, &step.FinishedAt)
+		if err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(arguments), &step.Arguments)
+		step.Error = stepErr.String
+		steps = append(steps, step)
+	}
+	return steps, rows.Err()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// amount of delivery attempts of a webhook, the delay between attempts
+// doubles starting with WEBHOOK_BACKOFF
+const WEBHOOK_ATTEMPTS = 5
+
+const WEBHOOK_BACKOFF = 2 * time.Second
+
+// validCallbackURL only accepts absolute http(s) URLs
+func validCallbackURL(callbackURL string) bool {
+	parsed, err := url.Parse(callbackURL)
+	if err != nil {
+		return false
+	}
+	return (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// signPayload returns the hex encoded HMAC-SHA256 of the body, keyed with
+// the WEBHOOK_SECRET environment variable
+func signPayload(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("WEBHOOK_SECRET")))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyWebhook posts the final status of a job to its callback URL. The body
+// is signed in the X-Companion-Signature header as "sha256=<hex hmac>".
+func notifyWebhook(callbackURL string, status JobStatus) {
+	uuid := status.UniqueID
+	body, err := json.Marshal(status)
+	if err != nil {
+		fmt.Printf("Failed to marshal webhook body: %v", err)
+		return
+	}
+	signature := "sha256=" + signPayload(body)
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	backoff := WEBHOOK_BACKOFF
+	for attempt := 1; attempt <= WEBHOOK_ATTEMPTS; attempt++ {
+		req, err := http.NewRequest("POST", callbackURL, bytes.NewBuffer(body))
+		if err != nil {
+			fmt.Printf("Failed to create webhook request: %v", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Companion-Signature", signature)
+		req.Header.Set("X-Companion-Job", uuid)
+
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("callback answered %d", resp.StatusCode)
+		}
+		fmt.Printf("Webhook for job %s failed (attempt %d/%d): %v\n", uuid, attempt, WEBHOOK_ATTEMPTS, err)
+		if attempt < WEBHOOK_ATTEMPTS {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}